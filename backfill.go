@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/checkpoint"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/metrics"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/sink"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+// backfill imports the history of a meter for the given range, resuming where a previous run left off.
+func backfill(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	meterNumber := flags.String("meter", "", "meter number")
+	from := flags.String("from", "", "first day to import (YYYY-MM-DD), defaults to start of meter")
+	to := flags.String("to", "", "last day to import (YYYY-MM-DD), defaults to end of meter")
+	chunkDays := flags.Int("chunk", 7, "number of days exported at once")
+	stateFile := flags.String("state", "backfill.json", "file storing the backfill progress")
+	flags.Parse(args)
+
+	if len(*meterNumber) == 0 {
+		return errors.New("meter number not specified")
+	}
+	if *chunkDays <= 0 {
+		return errors.New("chunk must be at least one day")
+	}
+	if len(sinks) == 0 {
+		return errors.New("no sink to backfill, the prometheus sink only exposes the latest hour")
+	}
+
+	progress, err := checkpoint.Load(*stateFile)
+	if err != nil {
+		return fmt.Errorf("could not load backfill progress [%s]", err.Error())
+	}
+
+	start := time.Now()
+	client, meter, err := findMeter(ctx, *meterNumber)
+	if err != nil {
+		return err
+	}
+
+	// already fetched data is still exported and the session closed when shutting down
+	flushCtx, cancel := flushContext(ctx)
+	defer cancel()
+	defer client.Logout(flushCtx)
+
+	// range is limited by the dates the meter provides data for (excluding endDate as it never has values)
+	startDate, _ := time.ParseInLocation("2006-01-02", meter.StartDate, torontohydro.Location)
+	endDate, _ := time.ParseInLocation("2006-01-02", meter.EndDate, torontohydro.Location)
+	if len(*from) > 0 {
+		fromDate, err := time.ParseInLocation("2006-01-02", *from, torontohydro.Location)
+		if err != nil {
+			return fmt.Errorf("invalid from date [%s]", *from)
+		}
+		if fromDate.After(startDate) {
+			startDate = fromDate
+		}
+	}
+	if len(*to) > 0 {
+		toDate, err := time.ParseInLocation("2006-01-02", *to, torontohydro.Location)
+		if err != nil {
+			return fmt.Errorf("invalid to date [%s]", *to)
+		}
+		if toDate.Before(endDate) {
+			endDate = toDate.AddDate(0, 0, 1)
+		}
+	}
+	totalDays := days(startDate, endDate)
+	if totalDays <= 0 {
+		log.Println("Nothing to backfill")
+		return nil
+	}
+
+	// resume after last imported day of a previous run with the same start, the end of the meter moves every day
+	key := meter.MeterNumber + " " + startDate.Format("2006-01-02")
+	date := startDate
+	if lastDay, ok := progress.Get(key, torontohydro.Location); ok && !lastDay.Before(startDate) {
+		date = lastDay.AddDate(0, 0, 1)
+		if !endDate.After(date) {
+			log.Printf("Backfill of meter %s already finished at %s\n", meter.MeterNumber, lastDay.Format("2006-01-02"))
+			return nil
+		}
+		log.Printf("Resuming backfill of meter %s at %s\n", meter.MeterNumber, date.Format("2006-01-02"))
+	}
+
+	var failures []failure
+	for endDate.After(date) {
+		chunkEnd := date.AddDate(0, 0, *chunkDays)
+		if chunkEnd.After(endDate) {
+			chunkEnd = endDate
+		}
+
+		consumptions, lastDay, chunkFailures := fetchDays(ctx, client, *meter, date, chunkEnd, settledBefore(time.Now()))
+		failures = append(failures, chunkFailures...)
+		if len(consumptions) > 0 {
+			phaseStart := time.Now()
+			err = sink.Export(flushCtx, sinks, dedup, *meter, consumptions, config.Revisions.Update)
+			metrics.ObservePhase("export", phaseStart)
+			state.Exported(err)
+			if err != nil {
+				return fmt.Errorf("backfill stopped at %s, rerun to resume", date.Format("2006-01-02"))
+			}
+		}
+
+		// interrupted, only the days fetched without gap are done
+		if ctx.Err() != nil {
+			if !lastDay.IsZero() {
+				date = lastDay.AddDate(0, 0, 1)
+				err = progress.Set(key, lastDay)
+				if err != nil {
+					log.Printf("Error saving backfill progress [%s]!\n", err.Error())
+				}
+			}
+			logFailures(failures)
+			return fmt.Errorf("backfill interrupted at %s, rerun to resume", date.Format("2006-01-02"))
+		}
+
+		// days without data are skipped, other failures are retried by the next run
+		if failed, ok := firstRetryable(chunkFailures); ok {
+			if failed.After(date) {
+				err = progress.Set(key, failed.AddDate(0, 0, -1))
+				if err != nil {
+					log.Printf("Error saving backfill progress [%s]!\n", err.Error())
+				}
+			}
+			logFailures(failures)
+			return fmt.Errorf("backfill stopped at %s as it could not be fetched, rerun to retry", failed.Format("2006-01-02"))
+		}
+		if len(chunkFailures) > 0 {
+			log.Printf("No data for %d days between %s and %s\n", len(chunkFailures), date.Format("2006-01-02"), chunkEnd.AddDate(0, 0, -1).Format("2006-01-02"))
+		}
+
+		err = progress.Set(key, chunkEnd.AddDate(0, 0, -1))
+		if err != nil {
+			log.Printf("Error saving backfill progress [%s]!\n", err.Error())
+		}
+
+		doneDays := days(startDate, chunkEnd)
+		log.Printf("Backfill progress for meter %s: %d/%d days (%.1f%%)\n", meter.MeterNumber, doneDays, totalDays, float64(doneDays)*100/float64(totalDays))
+		date = chunkEnd
+	}
+
+	logFailures(failures)
+	log.Printf("Backfill finished in %s\n", time.Since(start))
+	return nil
+}
+
+// firstRetryable returns the first day that failed for another reason than having no data yet.
+func firstRetryable(failures []failure) (time.Time, bool) {
+	var first time.Time
+	for _, f := range failures {
+		if errors.Is(f.err, torontohydro.ErrNotAvailable) {
+			continue
+		}
+		if first.IsZero() || f.day.Before(first) {
+			first = f.day
+		}
+	}
+	return first, !first.IsZero()
+}
+
+// findMeter looks for the meter in all accounts, returns the logged in client of the account the meter belongs to.
+func findMeter(ctx context.Context, meterNumber string) (*torontohydro.Client, *torontohydro.Meter, error) {
+	for _, client := range clients {
+		err := client.Login(ctx)
+		if err != nil {
+			return nil, nil, errors.New("could not log into Toronto Hydro")
+		}
+		meters, err := client.GetMeters(ctx)
+		if err != nil {
+			client.Logout(context.Background())
+			return nil, nil, errors.New("could not get meters")
+		}
+		for i := range meters {
+			if meters[i].MeterNumber == meterNumber {
+				return client, &meters[i], nil
+			}
+		}
+		client.Logout(context.Background())
+	}
+	return nil, nil, fmt.Errorf("meter [%s] not found", meterNumber)
+}
+
+// days returns the number of days between start and end, rounded to account for daylight saving time.
+func days(start time.Time, end time.Time) int {
+	return int(end.Sub(start).Hours()/24 + 0.5)
+}
@@ -0,0 +1,90 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Checkpoints keeps the last fully ingested day per meter in a JSON file.
+type Checkpoints struct {
+	path  string
+	mutex sync.Mutex
+	days  map[string]string
+}
+
+// Load reads the checkpoints from the file, a missing file results in no checkpoints.
+func Load(path string) (*Checkpoints, error) {
+	c := &Checkpoints{
+		path: path,
+		days: map[string]string{},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &c.days)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get returns the last fully ingested day of the meter.
+func (c *Checkpoints) Get(meter string, location *time.Location) (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	day, ok := c.days[meter]
+	if !ok {
+		return time.Time{}, false
+	}
+	date, err := time.ParseInLocation("2006-01-02", day, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// Set stores the last fully ingested day of the meter, checkpoints never move backwards.
+func (c *Checkpoints) Set(meter string, day time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value := day.Format("2006-01-02")
+	if current, ok := c.days[meter]; ok && current >= value {
+		return nil
+	}
+	c.days[meter] = value
+	return c.save()
+}
+
+func (c *Checkpoints) save() error {
+	data, err := json.MarshalIndent(c.days, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to temporary file first, so an interrupted write can't corrupt the checkpoints
+	temp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err != nil {
+		temp.Close()
+		return err
+	}
+	err = temp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), c.path)
+}
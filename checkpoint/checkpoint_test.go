@@ -0,0 +1,74 @@
+package checkpoint
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpoints(t *testing.T) {
+	location, _ := time.LoadLocation("America/Toronto")
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+
+	checkpoints, err := Load(path)
+	if err != nil {
+		t.Fatalf("missing file not accepted [%s]", err.Error())
+	}
+	if _, ok := checkpoints.Get("1234", location); ok {
+		t.Error("checkpoint without file")
+	}
+
+	day := time.Date(2023, 3, 12, 0, 0, 0, 0, location)
+	if err := checkpoints.Set("1234", day); err != nil {
+		t.Fatal(err)
+	}
+	// checkpoints never move backwards
+	if err := checkpoints.Set("1234", day.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoints.Set("5678", day.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for meter, want := range map[string]time.Time{"1234": day, "5678": day.AddDate(0, 0, 1)} {
+		got, ok := reloaded.Get(meter, location)
+		if !ok || !got.Equal(want) || got.Location() != location {
+			t.Errorf("meter %s: checkpoint = %s, %v, want %s", meter, got, ok, want)
+		}
+	}
+
+	// no temporary files are left behind
+	files, _ := filepath.Glob(path + ".*")
+	if len(files) > 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("corrupt file accepted")
+	}
+}
+
+func TestGetInvalidDay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	if err := os.WriteFile(path, []byte(`{"1234": "yesterday"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkpoints.Get("1234", time.UTC); ok {
+		t.Error("invalid day returned")
+	}
+}
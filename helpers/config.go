@@ -1,66 +1,311 @@
 package helpers
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	InfluxDB       InfluxDB     `yaml:"influxDB"`
-	TorontoHydro   TorontoHydro `yaml:"torontoHydro"`
-	SleepDuration  int          `yaml:"sleepDuration"`
-	LookDaysInPast int          `yaml:"lookDaysInPast"`
+	Sinks           []string     `yaml:"sinks"`
+	InfluxDB        InfluxDB     `yaml:"influxDB"`
+	Prometheus      Prometheus   `yaml:"prometheus"`
+	Status          Status       `yaml:"status"`
+	RemoteWrite     RemoteWrite  `yaml:"remoteWrite"`
+	MQTT            MQTT         `yaml:"mqtt"`
+	SQLite          SQLite       `yaml:"sqlite"`
+	Postgres        Postgres     `yaml:"postgres"`
+	TorontoHydro    TorontoHydro `yaml:"torontoHydro"`
+	SleepDuration   int          `yaml:"sleepDuration"`
+	ShutdownTimeout int          `yaml:"shutdownTimeout"`
+	Schedule        Schedule     `yaml:"schedule"`
+	LookDaysInPast  int          `yaml:"lookDaysInPast"`
+	Checkpoint      Checkpoint   `yaml:"checkpoint"`
+	Revisions       Revisions    `yaml:"revisions"`
 }
 
 type InfluxDB struct {
+	Version         int    `yaml:"version"`
+	URL             string `yaml:"url"`
+	Token           Secret `yaml:"token"`
+	TokenFile       string `yaml:"tokenFile"`
+	Organization    string `yaml:"organization"`
+	Bucket          string `yaml:"bucket"`
+	Username        string `yaml:"username"`
+	Password        Secret `yaml:"password"`
+	PasswordFile    string `yaml:"passwordFile"`
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retentionPolicy"`
+	Measurement     string `yaml:"measurement"`
+	Schema          int    `yaml:"schema"`
+}
+
+type Prometheus struct {
+	Address string `yaml:"address"`
+}
+
+type Status struct {
+	Address string `yaml:"address"`
+}
+
+type RemoteWrite struct {
 	URL          string `yaml:"url"`
-	Token        string `yaml:"token"`
-	Organization string `yaml:"organization"`
-	Bucket       string `yaml:"bucket"`
+	Username     string `yaml:"username"`
+	Password     Secret `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+type MQTT struct {
+	Broker          string `yaml:"broker"`
+	Username        string `yaml:"username"`
+	Password        Secret `yaml:"password"`
+	PasswordFile    string `yaml:"passwordFile"`
+	ClientID        string `yaml:"clientID"`
+	TopicPrefix     string `yaml:"topicPrefix"`
+	DiscoveryPrefix string `yaml:"discoveryPrefix"`
+}
+
+type SQLite struct {
+	Path  string `yaml:"path"`
+	Dedup bool   `yaml:"dedup"`
+}
+
+type Postgres struct {
+	URL         Secret `yaml:"url"`
+	URLFile     string `yaml:"urlFile"`
+	TimescaleDB bool   `yaml:"timescaleDB"`
 }
 
 type TorontoHydro struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Mock     bool   `yaml:"mock"`
+	Username          string    `yaml:"username"`
+	Password          Secret    `yaml:"password"`
+	PasswordFile      string    `yaml:"passwordFile"`
+	Mock              bool      `yaml:"mock"`
+	Workers           int       `yaml:"workers"`
+	RequestsPerSecond float64   `yaml:"requestsPerSecond"`
+	Retries           int       `yaml:"retries"`
+	RetryBackoff      int       `yaml:"retryBackoff"`
+	Accounts          []Account `yaml:"accounts"`
 }
 
+// TagKeys returns the sorted keys of the tags of all accounts.
+func (t TorontoHydro) TagKeys() []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, account := range t.Accounts {
+		for key := range account.Tags {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type Account struct {
+	Name         string            `yaml:"name"`
+	Username     string            `yaml:"username"`
+	Password     Secret            `yaml:"password"`
+	PasswordFile string            `yaml:"passwordFile"`
+	Tags         map[string]string `yaml:"tags"`
+}
+
+type Schedule struct {
+	Cron         string `yaml:"cron"`
+	Timezone     string `yaml:"timezone"`
+	Jitter       int    `yaml:"jitter"`
+	RunAtStartup bool   `yaml:"runAtStartup"`
+}
+
+// Parse returns the cron schedule and the location its times are evaluated in.
+func (s Schedule) Parse() (cron.Schedule, *time.Location, error) {
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown timezone [%s]", s.Timezone)
+	}
+	schedule, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	return schedule, location, nil
+}
+
+type Revisions struct {
+	Update  bool `yaml:"update"`
+	History bool `yaml:"history"`
+}
+
+type Checkpoint struct {
+	Path         string `yaml:"path"`
+	RevisionDays int    `yaml:"revisionDays"`
+}
+
+// ReadConfig loads and validates the configuration file, exits if it can't be used.
 func ReadConfig(configFile string) Config {
+	appConfig, err := LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Error reading the configuration file [%s]!\n", err.Error())
+	}
+
+	err = appConfig.Validate()
+	if err != nil {
+		log.Fatalf("Configuration file is invalid:\n%s\n", err.Error())
+	}
+
+	return appConfig
+}
+
+// LoadConfig reads the configuration file and applies defaults, unknown keys are rejected.
+func LoadConfig(configFile string) (Config, error) {
 	var appConfig Config
 
 	// check if specific
 	if len(configFile) == 0 {
-		log.Fatalln("Configuration file not specified!")
+		return appConfig, errors.New("configuration file not specified")
 	}
 
 	// check file ending
 	if filepath.Ext(configFile) != ".yml" {
-		log.Fatalln("Configuration file is not YAML!")
+		return appConfig, errors.New("configuration file is not YAML")
 	}
 
 	// check if file exists
 	if !fileExists(configFile) {
-		log.Fatalln("Configuration file doesn't exist!")
+		return appConfig, errors.New("configuration file doesn't exist")
 	}
 
 	// load file into config object
 	f, err := os.Open(configFile)
 	if err != nil {
-		log.Fatalln("Error reading the configuration file!")
+		return appConfig, err
 	}
 	defer f.Close()
 
 	decoder := yaml.NewDecoder(f)
+	decoder.SetStrict(true)
 	err = decoder.Decode(&appConfig)
+	if err != nil && err != io.EOF {
+		return appConfig, fmt.Errorf("is it valid YAML? %s", err.Error())
+	}
 
-	if err != nil {
-		log.Fatalln("Error reading the configuration file! Is it valid YAML?")
+	// resolve ${ENV_VAR} references and secrets stored in files
+	expandEnv(reflect.ValueOf(&appConfig))
+	for _, secret := range []struct {
+		value *Secret
+		file  string
+	}{
+		{&appConfig.InfluxDB.Token, appConfig.InfluxDB.TokenFile},
+		{&appConfig.InfluxDB.Password, appConfig.InfluxDB.PasswordFile},
+		{&appConfig.RemoteWrite.Password, appConfig.RemoteWrite.PasswordFile},
+		{&appConfig.MQTT.Password, appConfig.MQTT.PasswordFile},
+		{&appConfig.Postgres.URL, appConfig.Postgres.URLFile},
+		{&appConfig.TorontoHydro.Password, appConfig.TorontoHydro.PasswordFile},
+	} {
+		err = readSecretFile(secret.value, secret.file)
+		if err != nil {
+			return appConfig, err
+		}
+	}
+	for i := range appConfig.TorontoHydro.Accounts {
+		err = readSecretFile(&appConfig.TorontoHydro.Accounts[i].Password, appConfig.TorontoHydro.Accounts[i].PasswordFile)
+		if err != nil {
+			return appConfig, err
+		}
 	}
 
-	return appConfig
+	appConfig.setDefaults()
+	return appConfig, nil
+}
+
+// setDefaults fills in settings that are not specified.
+func (c *Config) setDefaults() {
+	// export to influxdb if no sinks are specified
+	if len(c.Sinks) == 0 {
+		c.Sinks = []string{"influxDB"}
+	}
+
+	// legacy influxdb layout
+	if len(c.InfluxDB.Measurement) == 0 {
+		c.InfluxDB.Measurement = "toronto_hydro"
+	}
+	if c.InfluxDB.Schema == 0 {
+		c.InfluxDB.Schema = 1
+	}
+
+	// default address of prometheus metrics endpoint
+	if len(c.Prometheus.Address) == 0 {
+		c.Prometheus.Address = ":9101"
+	}
+
+	// default mqtt settings
+	if len(c.MQTT.ClientID) == 0 {
+		c.MQTT.ClientID = "toronto-hydro-exporter"
+	}
+	if len(c.MQTT.TopicPrefix) == 0 {
+		c.MQTT.TopicPrefix = "torontohydro"
+	}
+	if len(c.MQTT.DiscoveryPrefix) == 0 {
+		c.MQTT.DiscoveryPrefix = "homeassistant"
+	}
+
+	// single account without name if no accounts are listed, else name defaults to username
+	if len(c.TorontoHydro.Accounts) == 0 {
+		c.TorontoHydro.Accounts = []Account{{
+			Username: c.TorontoHydro.Username,
+			Password: c.TorontoHydro.Password,
+		}}
+	} else {
+		for i := range c.TorontoHydro.Accounts {
+			if len(c.TorontoHydro.Accounts[i].Name) == 0 {
+				c.TorontoHydro.Accounts[i].Name = c.TorontoHydro.Accounts[i].Username
+			}
+		}
+	}
+
+	// fetch days one after another by default
+	if c.TorontoHydro.Workers == 0 {
+		c.TorontoHydro.Workers = 1
+	}
+
+	// retry transient failures by default, negative retries disable retrying
+	if c.TorontoHydro.Retries == 0 {
+		c.TorontoHydro.Retries = 3
+	} else if c.TorontoHydro.Retries < 0 {
+		c.TorontoHydro.Retries = 0
+	}
+	if c.TorontoHydro.RetryBackoff == 0 {
+		c.TorontoHydro.RetryBackoff = 1
+	}
+
+	// time to finish the current export when shutting down
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30
+	}
+
+	// default sqlite database file
+	if len(c.SQLite.Path) == 0 {
+		c.SQLite.Path = "torontohydro.db"
+	}
+}
+
+// String returns the configuration as YAML with all secrets masked.
+func (c Config) String() string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
 }
 
 func fileExists(filename string) bool {
@@ -0,0 +1,90 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Secret is a configuration value, e.g. a password, that is masked whenever printed or serialized.
+type Secret string
+
+func (s Secret) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return "********"
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${ENV_VAR} in all strings of the value with the environment variable.
+func expandEnv(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			expandEnv(value.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			expandEnv(value.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			expandEnv(value.Index(i))
+		}
+	case reflect.Map:
+		if value.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, key := range value.MapKeys() {
+			expanded := reflect.ValueOf(expandString(value.MapIndex(key).String())).Convert(value.Type().Elem())
+			value.SetMapIndex(key, expanded)
+		}
+	case reflect.String:
+		if value.CanSet() {
+			value.SetString(expandString(value.String()))
+		}
+	}
+}
+
+func expandString(value string) string {
+	return envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		name := envPattern.FindStringSubmatch(match)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			log.Printf("Environment variable [%s] referenced in configuration is not set!\n", name)
+		}
+		return env
+	})
+}
+
+// readSecretFile sets the secret to the content of the file, if one is given.
+func readSecretFile(secret *Secret, file string) error {
+	if len(file) == 0 {
+		return nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read secret file [%s]", file)
+	}
+	// files usually end with a line break
+	*secret = Secret(strings.TrimRight(string(content), "\r\n"))
+	return nil
+}
@@ -0,0 +1,166 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ValidationErrors lists all problems found in a configuration, each prefixed by the path of the field.
+type ValidationErrors []string
+
+func (v ValidationErrors) Error() string {
+	return strings.Join(v, "\n")
+}
+
+// add records a problem with the field at the given path.
+func (v *ValidationErrors) add(path string, format string, args ...interface{}) {
+	*v = append(*v, path+": "+fmt.Sprintf(format, args...))
+}
+
+// reservedTags are set on exported points, e.g. hour on revisions, and can't be used as account tags.
+var reservedTags = []string{"meter", "plan", "period", "account", "hour"}
+
+// tagKey matches the tag keys that are valid Prometheus label names.
+var tagKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate checks the configuration for missing or invalid settings, returns all problems at once.
+func (c Config) Validate() error {
+	var problems ValidationErrors
+
+	// sinks
+	enabled := map[string]bool{}
+	for i, name := range c.Sinks {
+		path := fmt.Sprintf("sinks[%d]", i)
+		switch name {
+		case "influxDB", "prometheus", "remoteWrite", "mqtt", "postgres", "sqlite":
+		default:
+			problems.add(path, "unknown sink [%s], must be one of influxDB, prometheus, remoteWrite, mqtt, postgres or sqlite", name)
+			continue
+		}
+		if enabled[name] {
+			problems.add(path, "sink [%s] is listed more than once", name)
+		}
+		enabled[name] = true
+	}
+
+	if enabled["influxDB"] {
+		if len(c.InfluxDB.URL) == 0 {
+			problems.add("influxDB.url", "is required")
+		}
+		switch c.InfluxDB.Version {
+		case 0, 2:
+			if len(c.InfluxDB.Token) == 0 {
+				problems.add("influxDB.token", "is required for InfluxDB 2")
+			}
+			if len(c.InfluxDB.Organization) == 0 {
+				problems.add("influxDB.organization", "is required for InfluxDB 2")
+			}
+			if len(c.InfluxDB.Bucket) == 0 {
+				problems.add("influxDB.bucket", "is required for InfluxDB 2")
+			}
+		case 1:
+			if len(c.InfluxDB.Database) == 0 {
+				problems.add("influxDB.database", "is required for InfluxDB 1")
+			}
+		default:
+			problems.add("influxDB.version", "must be 1 or 2, got %d", c.InfluxDB.Version)
+		}
+		if c.InfluxDB.Schema < 1 || c.InfluxDB.Schema > 3 {
+			problems.add("influxDB.schema", "must be 1, 2 or 3, got %d", c.InfluxDB.Schema)
+		}
+	}
+	if enabled["remoteWrite"] && len(c.RemoteWrite.URL) == 0 {
+		problems.add("remoteWrite.url", "is required")
+	}
+	if enabled["mqtt"] && len(c.MQTT.Broker) == 0 {
+		problems.add("mqtt.broker", "is required")
+	}
+	if enabled["postgres"] && len(c.Postgres.URL) == 0 {
+		problems.add("postgres.url", "is required")
+	}
+	if c.SQLite.Dedup && !enabled["sqlite"] {
+		problems.add("sqlite.dedup", "requires the sqlite sink")
+	}
+
+	// accounts, a single unnamed account is the legacy torontoHydro username and password
+	names := map[string]bool{}
+	for i, account := range c.TorontoHydro.Accounts {
+		path := fmt.Sprintf("torontoHydro.accounts[%d]", i)
+		if len(c.TorontoHydro.Accounts) == 1 && len(account.Name) == 0 {
+			path = "torontoHydro"
+		}
+		if !c.TorontoHydro.Mock {
+			if len(account.Username) == 0 {
+				problems.add(path+".username", "is required")
+			}
+			if len(account.Password) == 0 {
+				problems.add(path+".password", "is required")
+			}
+		}
+		if len(account.Name) > 0 {
+			if names[account.Name] {
+				problems.add(path+".name", "account [%s] is listed more than once", account.Name)
+			}
+			names[account.Name] = true
+		}
+		var keys []string
+		for key := range account.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !tagKey.MatchString(key) || strings.HasPrefix(key, "__") {
+				problems.add(path+".tags", "tag [%s] must start with a letter or underscore followed by letters, digits or underscores", key)
+			}
+			for _, reserved := range reservedTags {
+				if key == reserved {
+					problems.add(path+".tags", "tag [%s] is reserved", key)
+				}
+			}
+		}
+	}
+
+	// numbers
+	if c.SleepDuration < 0 {
+		problems.add("sleepDuration", "must not be negative")
+	}
+	if len(c.Schedule.Cron) > 0 {
+		if _, err := cron.ParseStandard(c.Schedule.Cron); err != nil {
+			problems.add("schedule.cron", "%s", err.Error())
+		}
+		if _, err := time.LoadLocation(c.Schedule.Timezone); err != nil {
+			problems.add("schedule.timezone", "unknown timezone [%s]", c.Schedule.Timezone)
+		}
+	}
+	if c.ShutdownTimeout < 0 {
+		problems.add("shutdownTimeout", "must not be negative")
+	}
+	if c.Schedule.Jitter < 0 {
+		problems.add("schedule.jitter", "must not be negative")
+	}
+	if c.LookDaysInPast < 0 {
+		problems.add("lookDaysInPast", "must not be negative")
+	}
+	if c.Checkpoint.RevisionDays < 0 {
+		problems.add("checkpoint.revisionDays", "must not be negative")
+	}
+	if c.TorontoHydro.Workers < 0 {
+		problems.add("torontoHydro.workers", "must not be negative")
+	}
+	if c.TorontoHydro.RequestsPerSecond < 0 {
+		problems.add("torontoHydro.requestsPerSecond", "must not be negative")
+	}
+	if c.TorontoHydro.RetryBackoff < 0 {
+		problems.add("torontoHydro.retryBackoff", "must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes the configuration to a temporary file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const validConfig = `
+influxDB:
+  url: http://localhost:8086
+  token: token
+  organization: home
+  bucket: hydro
+torontoHydro:
+  username: user
+  password: secret
+`
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, validConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("valid configuration rejected:\n%s", err.Error())
+	}
+
+	if !reflect.DeepEqual(config.Sinks, []string{"influxDB"}) {
+		t.Errorf("sinks = %v, want [influxDB]", config.Sinks)
+	}
+	if config.InfluxDB.Measurement != "toronto_hydro" || config.InfluxDB.Schema != 1 {
+		t.Errorf("influxDB measurement = %s, schema = %d", config.InfluxDB.Measurement, config.InfluxDB.Schema)
+	}
+	if config.Prometheus.Address != ":9101" {
+		t.Errorf("prometheus.address = %s", config.Prometheus.Address)
+	}
+	if config.TorontoHydro.Workers != 1 || config.TorontoHydro.Retries != 3 || config.TorontoHydro.RetryBackoff != 1 {
+		t.Errorf("torontoHydro workers = %d, retries = %d, retryBackoff = %d", config.TorontoHydro.Workers, config.TorontoHydro.Retries, config.TorontoHydro.RetryBackoff)
+	}
+	if config.ShutdownTimeout != 30 {
+		t.Errorf("shutdownTimeout = %d", config.ShutdownTimeout)
+	}
+	accounts := config.TorontoHydro.Accounts
+	if len(accounts) != 1 || accounts[0].Username != "user" || accounts[0].Password != "secret" || len(accounts[0].Name) != 0 {
+		t.Errorf("accounts = %+v, want the legacy account", accounts)
+	}
+}
+
+func TestLoadConfigDisablesRetries(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, validConfig+"  retries: -1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TorontoHydro.Retries != 0 {
+		t.Errorf("retries = %d, want 0", config.TorontoHydro.Retries)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, validConfig+"  pasword: typo\n"))
+	if err == nil || !strings.Contains(err.Error(), "pasword") {
+		t.Errorf("error = %v, want unknown key pasword", err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("missing file name accepted")
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("missing file accepted")
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "config.json")); err == nil {
+		t.Error("file not ending with .yml accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		problems []string
+	}{
+		{
+			name: "unknown and duplicate sinks",
+			config: validConfig + `
+sinks: [influxDB, graphite, influxDB]
+`,
+			problems: []string{
+				"sinks[1]: unknown sink [graphite]",
+				"sinks[2]: sink [influxDB] is listed more than once",
+			},
+		},
+		{
+			name: "influxDB 2 settings",
+			config: `
+influxDB:
+  url: http://localhost:8086
+  schema: 4
+torontoHydro:
+  mock: true
+`,
+			problems: []string{
+				"influxDB.token: is required for InfluxDB 2",
+				"influxDB.organization: is required for InfluxDB 2",
+				"influxDB.bucket: is required for InfluxDB 2",
+				"influxDB.schema: must be 1, 2 or 3, got 4",
+			},
+		},
+		{
+			name: "influxDB 1 settings",
+			config: `
+influxDB:
+  version: 1
+torontoHydro:
+  mock: true
+`,
+			problems: []string{
+				"influxDB.url: is required",
+				"influxDB.database: is required for InfluxDB 1",
+			},
+		},
+		{
+			name: "sink settings",
+			config: `
+sinks: [remoteWrite, mqtt, postgres]
+sqlite:
+  dedup: true
+torontoHydro:
+  mock: true
+`,
+			problems: []string{
+				"remoteWrite.url: is required",
+				"mqtt.broker: is required",
+				"postgres.url: is required",
+				"sqlite.dedup: requires the sqlite sink",
+			},
+		},
+		{
+			name: "legacy account",
+			config: `
+sinks: [prometheus]
+torontoHydro:
+  username: user
+`,
+			problems: []string{
+				"torontoHydro.password: is required",
+			},
+		},
+		{
+			name: "accounts",
+			config: `
+sinks: [prometheus]
+torontoHydro:
+  accounts:
+    - name: home
+      username: user
+      password: secret
+      tags:
+        meter: main
+        my-tag: a
+    - name: home
+      password: secret
+`,
+			problems: []string{
+				"torontoHydro.accounts[0].tags: tag [meter] is reserved",
+				"torontoHydro.accounts[0].tags: tag [my-tag] must start with a letter or underscore",
+				"torontoHydro.accounts[1].username: is required",
+				"torontoHydro.accounts[1].name: account [home] is listed more than once",
+			},
+		},
+		{
+			name: "numbers and schedule",
+			config: `
+sinks: [prometheus]
+torontoHydro:
+  mock: true
+  workers: -1
+  requestsPerSecond: -1
+  retryBackoff: -1
+sleepDuration: -1
+shutdownTimeout: -1
+lookDaysInPast: -1
+checkpoint:
+  revisionDays: -1
+schedule:
+  cron: "not a cron"
+  timezone: Mars/Olympus
+  jitter: -1
+`,
+			problems: []string{
+				"sleepDuration: must not be negative",
+				"schedule.cron: ",
+				"schedule.timezone: unknown timezone [Mars/Olympus]",
+				"shutdownTimeout: must not be negative",
+				"schedule.jitter: must not be negative",
+				"lookDaysInPast: must not be negative",
+				"checkpoint.revisionDays: must not be negative",
+				"torontoHydro.workers: must not be negative",
+				"torontoHydro.requestsPerSecond: must not be negative",
+				"torontoHydro.retryBackoff: must not be negative",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := LoadConfig(writeConfig(t, test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = config.Validate()
+			var problems ValidationErrors
+			if !errors.As(err, &problems) {
+				t.Fatalf("error = %v, want ValidationErrors", err)
+			}
+			if len(problems) != len(test.problems) {
+				t.Errorf("got %d problems, want %d:\n%s", len(problems), len(test.problems), err.Error())
+			}
+			for i, want := range test.problems {
+				if i < len(problems) && !strings.HasPrefix(problems[i], want) {
+					t.Errorf("problem %d = %q, want prefix %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
@@ -1,121 +1,213 @@
 package influxdb
 
 import (
-	"container/list"
 	"context"
-	"log"
+	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/sink"
 	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
-func Export(meter torontohydro.Meter, consumptions *list.List, config helpers.Config) {
+// StoredMeter is a meter found in the measurement, with the time of its first and last point.
+type StoredMeter struct {
+	Meter torontohydro.Meter
+	First time.Time
+	Last  time.Time
+}
+
+type Sink struct {
+	config  helpers.InfluxDB
+	history bool
+	client  influxdb2.Client
+	http    http.Client
+}
+
+func NewSink(config helpers.Config) *Sink {
+	s := &Sink{
+		config:  config.InfluxDB,
+		history: config.Revisions.History,
+	}
+	if config.InfluxDB.Version == 1 {
+		s.http = http.Client{
+			Timeout: 30 * time.Second,
+		}
+	} else {
+		s.client = influxdb2.NewClient(config.InfluxDB.URL, string(config.InfluxDB.Token))
+	}
+	return s
+}
 
-	// create client objects
-	client := influxdb2.NewClient(config.InfluxDB.URL, config.InfluxDB.Token)
-	queryAPI := client.QueryAPI(config.InfluxDB.Organization)
-	writeAPI := client.WriteAPI(config.InfluxDB.Organization, config.InfluxDB.Bucket)
+func (s *Sink) Name() string {
+	return "influxDB"
+}
+
+func (s *Sink) Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	if s.config.Version == 1 {
+		return s.existingV1(ctx, meter, start, end)
+	}
 
-	// start & end can be determined based on list elements
-	startDateTime := consumptions.Front().Value.(*torontohydro.ElectricConsumption).Time.Add(-1 * time.Hour)
-	endDateTime := consumptions.Back().Value.(*torontohydro.ElectricConsumption).Time.Add(1 * time.Hour)
+	queryAPI := s.client.QueryAPI(s.config.Organization)
 
-	// check if entry is already stored, only consider last 7 days
-	query := `from(bucket: "` + config.InfluxDB.Bucket + `")
-		|> range(start: ` + strconv.FormatInt(startDateTime.Unix(), 10) + `, stop: ` + strconv.FormatInt(endDateTime.Unix(), 10) + `)
-		|> filter(fn: (r) => r["_measurement"] == "toronto_hydro")
+	// one record per stored hour instead of one per field
+	query := `from(bucket: "` + s.config.Bucket + `")
+		|> range(start: ` + strconv.FormatInt(start.Unix(), 10) + `, stop: ` + strconv.FormatInt(end.Unix(), 10) + `)
+		|> filter(fn: (r) => r["_measurement"] == "` + s.config.Measurement + `")
 		|> filter(fn: (r) => r["meter"] == "` + meter.MeterNumber + `")
-		|> filter(fn: (r) => r["_field"] == "UsageHighTier" or r["_field"] == "UsageLowTier" or r["_field"] == "UsageMidPeak" or r["_field"] == "UsageOffPeak" or r["_field"] == "UsageOnPeak")`
-	result, err := queryAPI.Query(context.Background(), query)
+		|> ` + fieldFilter(s.config.Schema) + `
+		|> keep(columns: ["_time"])
+		|> group()
+		|> unique(column: "_time")`
+	result, err := queryAPI.Query(ctx, query)
 	if err != nil {
-		log.Printf("Error calling InfluxDB [%s]!\n", err.Error())
-		return
+		return nil, err
 	}
 
-	// remove consumptions that have already been submitted
+	var timestamps []time.Time
 	for result.Next() {
-		var next *list.Element
-		for e := consumptions.Front(); e != nil; e = next {
-			next = e.Next()
-			if e.Value.(*torontohydro.ElectricConsumption).Time.Equal(result.Record().Time()) {
-				consumptions.Remove(e)
-				break
-			}
+		timestamps = append(timestamps, result.Record().Time())
+	}
+	return timestamps, result.Err()
+}
+
+// Stored returns the consumptions stored for the meter, used to detect revised hours.
+func (s *Sink) Stored(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]*torontohydro.ElectricConsumption, error) {
+	if s.config.Version == 1 {
+		return s.storedV1(ctx, meter, start, end)
+	}
+
+	queryAPI := s.client.QueryAPI(s.config.Organization)
+
+	// one row per hour (and plan and period) with a column per field
+	query := `from(bucket: "` + s.config.Bucket + `")
+		|> range(start: ` + strconv.FormatInt(start.Unix(), 10) + `, stop: ` + strconv.FormatInt(end.Unix(), 10) + `)
+		|> filter(fn: (r) => r["_measurement"] == "` + s.config.Measurement + `")
+		|> filter(fn: (r) => r["meter"] == "` + meter.MeterNumber + `")
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`
+	result, err := queryAPI.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// series of different tags are merged by time
+	byTime := map[int64]*torontohydro.ElectricConsumption{}
+	var consumptions []*torontohydro.ElectricConsumption
+	for result.Next() {
+		timestamp := result.Record().Time()
+		consumption, ok := byTime[timestamp.Unix()]
+		if !ok {
+			consumption = &torontohydro.ElectricConsumption{Time: timestamp}
+			byTime[timestamp.Unix()] = consumption
+			consumptions = append(consumptions, consumption)
 		}
+		setValues(consumption, result.Record().Values(), s.config.Schema)
+	}
+	return consumptions, result.Err()
+}
+
+// Meters returns the meters stored in the measurement, their account and tags are taken from their latest point.
+func (s *Sink) Meters(ctx context.Context) ([]StoredMeter, error) {
+	if s.config.Version == 1 {
+		return s.metersV1(ctx)
 	}
 
-	if consumptions.Len() > 0 {
-		// write remaining consumptions to influxdb
-		for e := consumptions.Front(); e != nil; e = e.Next() {
-			consumption := e.Value.(*torontohydro.ElectricConsumption)
-			if !hasData(consumption) {
-				log.Println("No data for " + consumption.Time.Format("2006-01-02 15:04:05"))
+	queryAPI := s.client.QueryAPI(s.config.Organization)
+
+	// first and last point of each meter
+	var meters []StoredMeter
+	byNumber := map[string]int{}
+	for _, selector := range []string{"min", "max"} {
+		query := `from(bucket: "` + s.config.Bucket + `")
+		|> range(start: 0)
+		|> filter(fn: (r) => r["_measurement"] == "` + s.config.Measurement + `")
+		|> group(columns: ["meter"])
+		|> ` + selector + `(column: "_time")`
+		result, err := queryAPI.Query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for result.Next() {
+			row := result.Record().Values()
+			number, ok := row["meter"].(string)
+			if !ok {
 				continue
 			}
-			log.Println("Inserting " + consumption.Time.Format("2006-01-02 15:04:05"))
-			point := influxdb2.NewPointWithMeasurement("toronto_hydro").
-				AddTag("meter", meter.MeterNumber).
-				SetTime(consumption.Time)
-			addField("UsageHighTier", consumption.UsageHighTier, point)
-			addField("UsageLowTier", consumption.UsageLowTier, point)
-			addField("UsageTOUOnPeak", consumption.UsageTOUOnPeak, point)
-			addField("UsageTOUMidPeak", consumption.UsageTOUMidPeak, point)
-			addField("UsageTOUOffPeak", consumption.UsageTOUOffPeak, point)
-			addField("UsageULOOvernight", consumption.UsageULOOvernight, point)
-			addField("UsageULOOffPeal", consumption.UsageULOOffPeal, point)
-			addField("UsageULOMidPeak", consumption.UsageULOMidPeak, point)
-			addField("UsageULOOnPeak", consumption.UsageULOOnPeak, point)
-			addField("CostHighTier", consumption.CostHighTier, point)
-			addField("CostLowTier", consumption.CostLowTier, point)
-			addField("CostTOUOnPeak", consumption.CostTOUOnPeak, point)
-			addField("CostTOUMidPeak", consumption.CostTOUMidPeak, point)
-			addField("CostTOUOffPeak", consumption.CostTOUOffPeak, point)
-			addField("CostULOOvernight", consumption.CostULOOvernight, point)
-			addField("CostULOOffPeal", consumption.CostULOOffPeal, point)
-			addField("CostULOMidPeak", consumption.CostULOMidPeak, point)
-			addField("CostULOOnPeak", consumption.CostULOOnPeak, point)
-			writeAPI.WritePoint(point)
+			index, ok := byNumber[number]
+			if !ok {
+				index = len(meters)
+				byNumber[number] = index
+				meters = append(meters, StoredMeter{Meter: torontohydro.Meter{MeterNumber: number}})
+			}
+			if selector == "min" {
+				meters[index].First = result.Record().Time()
+			} else {
+				meters[index].Last = result.Record().Time()
+				setLabels(&meters[index].Meter, row, s.config.Schema)
+			}
+		}
+		if result.Err() != nil {
+			return nil, result.Err()
 		}
+	}
+	return meters, nil
+}
 
-		// force all unwritten data to be sent
-		writeAPI.Flush()
+func (s *Sink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+	return s.writePoints(ctx, createPoints(s.config.Measurement, s.config.Schema, meter, consumptions))
+}
 
-	} else {
-		log.Println("No new metrics available, skip export to influx")
+// WriteRevisions records the old and new values of the revised hours in the revisions measurement if enabled.
+func (s *Sink) WriteRevisions(ctx context.Context, meter torontohydro.Meter, revisions []sink.Revision) error {
+	if !s.history {
+		return nil
 	}
 
-	// ensures background processes finishes
-	client.Close()
+	now := time.Now()
+	var points []*write.Point
+	for _, revision := range revisions {
+		point := influxdb2.NewPointWithMeasurement(s.config.Measurement+"_revisions").
+			AddTag("meter", meter.MeterNumber).
+			AddTag("hour", revision.New.Time.UTC().Format(time.RFC3339)).
+			SetTime(now)
+		for key, value := range meter.Labels() {
+			point.AddTag(key, value)
+		}
+		oldFields, newFields := revision.ChangedFields()
+		for i, old := range oldFields {
+			name := fieldName(old, s.config.Schema)
+			if s.config.Schema == SchemaTags {
+				name = old.Key()
+			}
+			addField(name+"_old", old.Value, point)
+			addField(name+"_new", newFields[i].Value, point)
+		}
+		points = append(points, point)
+	}
+	return s.writePoints(ctx, points)
 }
 
-func addField(name string, value float32, point *write.Point) {
-	if value > 0.0 {
-		point.AddField(name, value)
+func (s *Sink) writePoints(ctx context.Context, points []*write.Point) error {
+	if len(points) == 0 {
+		return nil
 	}
+
+	if s.config.Version == 1 {
+		return s.writeV1(ctx, points)
+	}
+	writeAPI := s.client.WriteAPIBlocking(s.config.Organization, s.config.Bucket)
+	return writeAPI.WritePoint(ctx, points...)
 }
 
-func hasData(consumption *torontohydro.ElectricConsumption) bool {
-	return consumption.UsageHighTier > 0.0 ||
-		consumption.UsageLowTier > 0.0 ||
-		consumption.UsageTOUOnPeak > 0.0 ||
-		consumption.UsageTOUMidPeak > 0.0 ||
-		consumption.UsageTOUOffPeak > 0.0 ||
-		consumption.UsageULOOvernight > 0.0 ||
-		consumption.UsageULOOffPeal > 0.0 ||
-		consumption.UsageULOMidPeak > 0.0 ||
-		consumption.UsageULOOnPeak > 0.0 ||
-		consumption.CostHighTier > 0.0 ||
-		consumption.CostLowTier > 0.0 ||
-		consumption.CostTOUOnPeak > 0.0 ||
-		consumption.CostTOUMidPeak > 0.0 ||
-		consumption.CostTOUOffPeak > 0.0 ||
-		consumption.CostULOOvernight > 0.0 ||
-		consumption.CostULOOffPeal > 0.0 ||
-		consumption.CostULOMidPeak > 0.0 ||
-		consumption.CostULOOnPeak > 0.0
+func (s *Sink) Close() {
+	if s.config.Version == 1 {
+		s.http.CloseIdleConnections()
+		return
+	}
+	// ensures background processes finishes
+	s.client.Close()
 }
@@ -0,0 +1,238 @@
+package influxdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+type queryResponse struct {
+	Results []struct {
+		Series []struct {
+			Columns []string        `json:"columns"`
+			Values  [][]interface{} `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// existingV1 queries the stored timestamps via InfluxQL.
+func (s *Sink) existingV1(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	response, err := s.queryV1(ctx, meter, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var timestamps []time.Time
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			for _, values := range series.Values {
+				if len(values) == 0 {
+					continue
+				}
+				// epoch=s returns the time column as seconds
+				if seconds, ok := values[0].(float64); ok {
+					timestamps = append(timestamps, time.Unix(int64(seconds), 0))
+				}
+			}
+		}
+	}
+	return timestamps, nil
+}
+
+// queryV1 selects all points of the meter between start and end via InfluxQL.
+func (s *Sink) queryV1(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) (*queryResponse, error) {
+	return s.runQueryV1(ctx, `SELECT * FROM "`+s.config.Measurement+`" WHERE "meter" = `+quoteV1(meter.MeterNumber)+
+		` AND time >= `+strconv.FormatInt(start.Unix(), 10)+`s AND time < `+strconv.FormatInt(end.Unix(), 10)+`s`)
+}
+
+// quoteV1 returns the string literal of the value in InfluxQL.
+func quoteV1(value string) string {
+	return `'` + strings.ReplaceAll(value, "'", "\\'") + `'`
+}
+
+// metersV1 lists the meters of the measurement via InfluxQL, with their first and last point.
+func (s *Sink) metersV1(ctx context.Context) ([]StoredMeter, error) {
+	response, err := s.runQueryV1(ctx, `SHOW TAG VALUES FROM "`+s.config.Measurement+`" WITH KEY = "meter"`)
+	if err != nil {
+		return nil, err
+	}
+
+	var meters []StoredMeter
+	for _, row := range rowsV1(response) {
+		number, ok := row["value"].(string)
+		if !ok {
+			continue
+		}
+		meter := StoredMeter{Meter: torontohydro.Meter{MeterNumber: number}}
+		for _, order := range []string{"ASC", "DESC"} {
+			response, err := s.runQueryV1(ctx, `SELECT * FROM "`+s.config.Measurement+`" WHERE "meter" = `+quoteV1(number)+` ORDER BY time `+order+` LIMIT 1`)
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range rowsV1(response) {
+				seconds, ok := row["time"].(float64)
+				if !ok {
+					continue
+				}
+				if order == "ASC" {
+					meter.First = time.Unix(int64(seconds), 0)
+				} else {
+					meter.Last = time.Unix(int64(seconds), 0)
+					setLabels(&meter.Meter, row, s.config.Schema)
+				}
+			}
+		}
+		meters = append(meters, meter)
+	}
+	return meters, nil
+}
+
+// rowsV1 returns the rows of all series of the response by column.
+func rowsV1(response *queryResponse) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			for _, values := range series.Values {
+				row := map[string]interface{}{}
+				for i, value := range values {
+					if i < len(series.Columns) {
+						row[series.Columns[i]] = value
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
+
+// runQueryV1 runs the InfluxQL query, times are returned in seconds.
+func (s *Sink) runQueryV1(ctx context.Context, query string) (*queryResponse, error) {
+	params := s.paramsV1()
+	params.Set("q", query)
+	params.Set("epoch", "s")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(s.config.URL, "/")+"/query?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.doV1(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response queryResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Error) > 0 {
+		return nil, fmt.Errorf("query failed: %s", response.Error)
+	}
+	for _, result := range response.Results {
+		if len(result.Error) > 0 {
+			return nil, fmt.Errorf("query failed: %s", result.Error)
+		}
+	}
+	return &response, nil
+}
+
+// storedV1 queries the stored consumptions via InfluxQL.
+func (s *Sink) storedV1(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]*torontohydro.ElectricConsumption, error) {
+	response, err := s.queryV1(ctx, meter, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// rows of the same hour are merged
+	byTime := map[int64]*torontohydro.ElectricConsumption{}
+	var consumptions []*torontohydro.ElectricConsumption
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			for _, values := range series.Values {
+				if len(values) == 0 {
+					continue
+				}
+				seconds, ok := values[0].(float64)
+				if !ok {
+					continue
+				}
+				consumption, ok := byTime[int64(seconds)]
+				if !ok {
+					consumption = &torontohydro.ElectricConsumption{Time: time.Unix(int64(seconds), 0)}
+					byTime[int64(seconds)] = consumption
+					consumptions = append(consumptions, consumption)
+				}
+				row := map[string]interface{}{}
+				for i, value := range values {
+					if i < len(series.Columns) {
+						row[series.Columns[i]] = value
+					}
+				}
+				setValues(consumption, row, s.config.Schema)
+			}
+		}
+	}
+	return consumptions, nil
+}
+
+// writeV1 writes the points as line protocol to the /write endpoint.
+func (s *Sink) writeV1(ctx context.Context, points []*write.Point) error {
+
+	var body strings.Builder
+	for _, point := range points {
+		write.PointToLineProtocolBuffer(point, &body, time.Second)
+	}
+	params := s.paramsV1()
+	params.Set("precision", "s")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(s.config.URL, "/")+"/write?"+params.Encode(), strings.NewReader(body.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := s.doV1(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *Sink) paramsV1() url.Values {
+	params := url.Values{}
+	params.Set("db", s.config.Database)
+	if len(s.config.RetentionPolicy) > 0 {
+		params.Set("rp", s.config.RetentionPolicy)
+	}
+	return params
+}
+
+func (s *Sink) doV1(req *http.Request) (*http.Response, error) {
+	if len(s.config.Username) > 0 {
+		req.SetBasicAuth(s.config.Username, string(s.config.Password))
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("InfluxDB responded with status code [%d]: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,157 @@
+package influxdb
+
+import (
+	"log"
+	"strings"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Versions of the layout of the points, see README.
+const (
+	// SchemaLegacy writes one point per hour with a field per value, two field names carry the typo "ULOOffPeal"
+	SchemaLegacy = 1
+	// SchemaFields writes one point per hour with a field per value
+	SchemaFields = 2
+	// SchemaTags writes one point per hour, plan and period with the fields usage and cost
+	SchemaTags = 3
+)
+
+// legacyNames maps the field names that differ in SchemaLegacy.
+var legacyNames = map[string]string{
+	"UsageULOOffPeak": "UsageULOOffPeal",
+	"CostULOOffPeak":  "CostULOOffPeal",
+}
+
+// fieldName returns the name of the field in the given schema.
+func fieldName(field torontohydro.Field, schema int) string {
+	switch schema {
+	case SchemaLegacy:
+		if legacy, ok := legacyNames[field.Name]; ok {
+			return legacy
+		}
+	case SchemaTags:
+		return field.Kind
+	}
+	return field.Name
+}
+
+// fieldNames returns the distinct field names of the given schema.
+func fieldNames(schema int) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, field := range (&torontohydro.ElectricConsumption{}).Fields() {
+		name := fieldName(field, schema)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// fieldFilter returns a Flux filter on all field names of the given schema.
+func fieldFilter(schema int) string {
+	var conditions []string
+	for _, name := range fieldNames(schema) {
+		conditions = append(conditions, `r["_field"] == "`+name+`"`)
+	}
+	return `filter(fn: (r) => ` + strings.Join(conditions, " or ") + `)`
+}
+
+// setValues sets the values of a stored row, e.g. a pivoted Flux record, on the consumption.
+func setValues(consumption *torontohydro.ElectricConsumption, row map[string]interface{}, schema int) {
+	for _, field := range consumption.Fields() {
+		var value interface{}
+		if schema == SchemaTags {
+			if row["plan"] != field.Plan || row["period"] != field.Period {
+				continue
+			}
+			value = row[field.Kind]
+		} else {
+			value = row[fieldName(field, schema)]
+		}
+		if number, ok := value.(float64); ok {
+			consumption.Set(field.Name, float32(number))
+		}
+	}
+}
+
+// setLabels sets the account and tags of the meter from the tag columns of a stored row.
+func setLabels(meter *torontohydro.Meter, row map[string]interface{}, schema int) {
+	skip := map[string]bool{"time": true, "result": true, "table": true, "meter": true, "plan": true, "period": true}
+	for _, name := range fieldNames(schema) {
+		skip[name] = true
+	}
+	meter.Tags = map[string]string{}
+	for key, value := range row {
+		tag, ok := value.(string)
+		if !ok || len(tag) == 0 || skip[key] || strings.HasPrefix(key, "_") {
+			continue
+		}
+		if key == "account" {
+			meter.Account = tag
+		} else {
+			meter.Tags[key] = tag
+		}
+	}
+}
+
+// createPoints converts the consumptions into points of the given measurement and schema.
+func createPoints(measurement string, schema int, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) []*write.Point {
+	var points []*write.Point
+	for _, consumption := range consumptions {
+		if !consumption.HasData() {
+			log.Println("No data for " + consumption.Time.Format("2006-01-02 15:04:05"))
+			continue
+		}
+		log.Println("Inserting " + consumption.Time.Format("2006-01-02 15:04:05"))
+
+		if schema != SchemaTags {
+			point := newPoint(measurement, meter, consumption)
+			for _, field := range consumption.Fields() {
+				addField(fieldName(field, schema), field.Value, point)
+			}
+			points = append(points, point)
+			continue
+		}
+
+		// one point per plan and period with usage and cost
+		byPlanPeriod := map[string]*write.Point{}
+		for _, field := range consumption.Fields() {
+			if field.Value == nil {
+				continue
+			}
+			point, ok := byPlanPeriod[field.Plan+"_"+field.Period]
+			if !ok {
+				point = newPoint(measurement, meter, consumption).
+					AddTag("plan", field.Plan).
+					AddTag("period", field.Period)
+				byPlanPeriod[field.Plan+"_"+field.Period] = point
+				points = append(points, point)
+			}
+			addField(field.Kind, field.Value, point)
+		}
+	}
+	return points
+}
+
+func newPoint(measurement string, meter torontohydro.Meter, consumption *torontohydro.ElectricConsumption) *write.Point {
+	point := influxdb2.NewPointWithMeasurement(measurement).
+		AddTag("meter", meter.MeterNumber).
+		SetTime(consumption.Time)
+	for key, value := range meter.Labels() {
+		point.AddTag(key, value)
+	}
+	return point
+}
+
+// addField adds the value unless its cell was empty, zero and negative values are kept.
+func addField(name string, value *float32, point *write.Point) {
+	if value != nil {
+		point.AddField(name, *value)
+	}
+}
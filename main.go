@@ -1,19 +1,48 @@
 package main
 
 import (
-	"container/list"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/dtrumpfheller/toronto-hydro-exporter/checkpoint"
 	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
 	"github.com/dtrumpfheller/toronto-hydro-exporter/influxdb"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/metrics"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/mqtt"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/postgres"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/prometheus"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/remotewrite"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/sink"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/sqlite"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/status"
 	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
 )
 
+// failure records a day that could not be fetched.
+type failure struct {
+	meter string
+	day   time.Time
+	err   error
+}
+
 var (
-	configFile = flag.String("config", "config.yml", "configuration file")
-	config     helpers.Config
+	configFile  = flag.String("config", "config.yml", "configuration file")
+	config      helpers.Config
+	clients     []*torontohydro.Client
+	sinks       []sink.Sink
+	dedup       sink.Sink
+	checkpoints *checkpoint.Checkpoints
+	state       *status.Status
 )
 
 func main() {
@@ -21,71 +50,436 @@ func main() {
 	// load arguments into variables
 	flag.Parse()
 
+	// only check the config file
+	if flag.Arg(0) == "validate-config" {
+		os.Exit(validateConfig(flag.Args()[1:]))
+	}
+
 	// load config file
 	config = helpers.ReadConfig(*configFile)
 
 	// setup mock if necessary
+	baseURL := torontohydro.DefaultBaseURL
 	if config.TorontoHydro.Mock {
-		torontohydro.Mock()
+		baseURL = torontohydro.Mock()
+	}
+
+	// setup a toronto hydro client per account, all share the limit of requests
+	limiter := torontohydro.NewRateLimiter(config.TorontoHydro.RequestsPerSecond)
+	for _, account := range config.TorontoHydro.Accounts {
+		client := torontohydro.New(account.Username, string(account.Password))
+		client.Name = account.Name
+		client.Tags = account.Tags
+		client.BaseURL = baseURL
+		client.Limiter = limiter
+		client.Retries = config.TorontoHydro.Retries
+		client.Backoff = time.Duration(config.TorontoHydro.RetryBackoff) * time.Second
+		client.Transport = metrics.Transport(http.DefaultTransport)
+		clients = append(clients, client)
+	}
+
+	// load checkpoints if enabled
+	if len(config.Checkpoint.Path) > 0 {
+		var err error
+		checkpoints, err = checkpoint.Load(config.Checkpoint.Path)
+		if err != nil {
+			log.Fatalf("Error loading checkpoints [%s]!\n", err.Error())
+		}
+	}
+
+	// setup sinks, migrate creates its own InfluxDB sinks and only the exporter serves HTTP endpoints
+	command := flag.Arg(0)
+	serve := len(command) == 0
+	if command != "migrate" {
+		sinks = createSinks(serve)
+	}
+
+	// serve health and status if enabled
+	state = status.New(sinks)
+	if serve && len(config.Status.Address) > 0 {
+		state.Serve(config.Status.Address)
+	}
+	state.Ready()
+
+	// stop on SIGTERM/SIGINT, a second signal terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+		state.Stopping()
+		log.Println("Shutting down...")
+	}()
+
+	var err error
+	switch command {
+	case "":
+		run(ctx)
+	case "backfill":
+		err = backfill(ctx, flag.Args()[1:])
+	case "migrate":
+		err = migrate(ctx, flag.Args()[1:])
+	default:
+		err = fmt.Errorf("unknown command [%s]", command)
+	}
+
+	sink.Close(sinks)
+	state.Close()
+	if err != nil {
+		log.Fatalf("Error: %s!\n", err.Error())
+	}
+}
+
+// validateConfig checks the config file given as argument or by the config flag, returns the exit code.
+func validateConfig(args []string) int {
+	file := *configFile
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	appConfig, err := helpers.LoadConfig(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the configuration file [%s]!\n", err.Error())
+		return 1
+	}
+
+	err = appConfig.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration file %s is invalid:\n%s\n", file, err.Error())
+		return 1
+	}
+
+	fmt.Printf("Configuration file %s is valid:\n%s", file, appConfig)
+	return 0
+}
+
+func run(ctx context.Context) {
+	if len(config.Schedule.Cron) > 0 {
+		runScheduled(ctx)
+		return
 	}
 
 	for {
 		// export metrics
-		exportMetrics()
+		exportMetrics(ctx)
 
 		if config.SleepDuration <= 0 {
 			break
 		}
-		time.Sleep(time.Duration(config.SleepDuration) * time.Minute)
+		duration := time.Duration(config.SleepDuration)*time.Minute + jitter()
+		state.SetNextRun(time.Now().Add(duration))
+		if !sleep(ctx, duration) {
+			break
+		}
+	}
+}
+
+// runScheduled exports the metrics at the times of the cron schedule.
+func runScheduled(ctx context.Context) {
+	schedule, location, err := config.Schedule.Parse()
+	if err != nil {
+		log.Fatalf("Error parsing schedule [%s]!\n", err.Error())
+	}
+
+	if config.Schedule.RunAtStartup {
+		exportMetrics(ctx)
+	}
+
+	for ctx.Err() == nil {
+		next := schedule.Next(time.Now().In(location)).Add(jitter())
+		log.Printf("Next export at %s\n", next.Format(time.RFC3339))
+		state.SetNextRun(next)
+		if !sleep(ctx, time.Until(next)) {
+			break
+		}
+
+		// export metrics
+		exportMetrics(ctx)
+	}
+}
+
+// sleep waits for the given duration, returns false if the context was cancelled before.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// flushContext returns a context for finishing work after ctx was cancelled, e.g. writing already fetched data.
+// It is cancelled once the shutdown timeout passed after ctx was cancelled, or when calling the cancel function.
+func flushContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	flushCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-flushCtx.Done():
+			return
+		}
+		timer := time.NewTimer(time.Duration(config.ShutdownTimeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-flushCtx.Done():
+		}
+	}()
+	return flushCtx, cancel
+}
+
+// jitter returns a random delay of up to the configured number of seconds.
+func jitter() time.Duration {
+	if config.Schedule.Jitter <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(int64(config.Schedule.Jitter) * int64(time.Second)))
 }
 
-func exportMetrics() {
+func exportMetrics(ctx context.Context) {
 	log.Println("Getting Toronto Hydro energy consumption... ")
 	start := time.Now()
 
-	err := torontohydro.Login(config)
+	var failures []failure
+	for _, client := range clients {
+		if ctx.Err() != nil {
+			break
+		}
+		failures = append(failures, exportAccount(ctx, client, start)...)
+	}
+
+	logFailures(failures)
+	state.RunFinished(time.Now())
+	metrics.RunFinished()
+	log.Printf("Finished in %s\n", time.Since(start))
+}
+
+// exportAccount exports the metrics of all meters of the account, returns the days that could not be fetched.
+func exportAccount(ctx context.Context, client *torontohydro.Client, start time.Time) []failure {
+	if len(client.Name) > 0 {
+		log.Printf("Exporting account %s\n", client.Name)
+	}
+
+	phaseStart := time.Now()
+	err := client.Login(ctx)
+	metrics.ObservePhase("login", phaseStart)
 	if err != nil {
-		return
+		state.Error(err)
+		return nil
 	}
 
-	meters, err := torontohydro.GetMeters(config)
+	// already fetched data is still exported and the session closed when shutting down
+	flushCtx, cancel := flushContext(ctx)
+	defer cancel()
+	defer client.Logout(flushCtx)
+
+	phaseStart = time.Now()
+	meters, err := client.GetMeters(ctx)
+	metrics.ObservePhase("meters", phaseStart)
 	if err != nil {
-		return
+		state.Error(err)
+		return nil
 	}
 
+	var failures []failure
 	for _, meter := range meters {
-		endDate, _ := time.ParseInLocation("2006-01-02", meter.EndDate, start.Location())
-		startDate, _ := time.ParseInLocation("2006-01-02", meter.StartDate, start.Location())
+		if ctx.Err() != nil {
+			break
+		}
+
+		endDate, _ := time.ParseInLocation("2006-01-02", meter.EndDate, torontohydro.Location)
+		startDate, _ := time.ParseInLocation("2006-01-02", meter.StartDate, torontohydro.Location)
 
-		date := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location()).AddDate(0, 0, -config.LookDaysInPast)
+		today := start.In(torontohydro.Location)
+		date := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, torontohydro.Location).AddDate(0, 0, -config.LookDaysInPast)
+		if checkpoints != nil {
+			// continue after last fully ingested day, refetching the revision window
+			if lastDay, ok := checkpoints.Get(meter.MeterNumber, torontohydro.Location); ok {
+				date = lastDay.AddDate(0, 0, 1-config.Checkpoint.RevisionDays)
+			}
+		}
 		if date.Before(startDate) {
 			date = startDate
 		}
 
 		// 1. get data
-		consumptions := list.New()
-
-		// for all days until endDate (excluding endDate as it never has values)
-		for ok := endDate.After(date); ok; ok = endDate.After(date) {
-			data, err := torontohydro.GetData(meter, date, config)
-			if err == nil {
-				for _, consumption := range data {
-					consumptions.PushBack(consumption)
-				}
+		consumptions, lastDay, meterFailures := fetchDays(ctx, client, meter, date, endDate, settledBefore(start))
+		failures = append(failures, meterFailures...)
+		for _, f := range meterFailures {
+			// days without data yet are expected and not reported as errors
+			if errors.Is(f.err, torontohydro.ErrNotAvailable) {
+				continue
 			}
-			date = date.AddDate(0, 0, 1)
+			state.MeterFailed(f.meter, meter.Account, fmt.Errorf("%s: %w", f.day.Format("2006-01-02"), f.err))
 		}
 
 		// 2. export data
-		if consumptions.Len() > 0 {
-			influxdb.Export(meter, consumptions, config)
+		if len(consumptions) > 0 {
+			phaseStart = time.Now()
+			err := sink.Export(flushCtx, sinks, dedup, meter, consumptions, config.Revisions.Update)
+			metrics.ObservePhase("export", phaseStart)
+			state.Exported(err)
+			if err != nil {
+				state.MeterFailed(meter.MeterNumber, meter.Account, err)
+			} else {
+				state.MeterExported(meter.MeterNumber, meter.Account, consumptions[len(consumptions)-1].Time)
+				metrics.MeterExported(meter.MeterNumber, meter.Account)
+			}
+			if err == nil && checkpoints != nil && !lastDay.IsZero() {
+				err = checkpoints.Set(meter.MeterNumber, lastDay)
+				if err != nil {
+					log.Printf("Error saving checkpoint [%s]!\n", err.Error())
+				}
+			}
 		} else {
-			log.Println("No data gathered, skipping export to influxDB")
+			log.Println("No data gathered, skipping export")
 		}
 	}
 
-	torontohydro.Logout(config)
+	return failures
+}
+
+// settledBefore returns the first day that might still get missing hours published, counted from now.
+// Incomplete days before it are not fetched again, so a gap in the data doesn't hold back the checkpoint.
+func settledBefore(now time.Time) time.Time {
+	// the previous day is usually published during the day
+	days := config.Checkpoint.RevisionDays
+	if days < 1 {
+		days = 1
+	}
+	today := now.In(torontohydro.Location)
+	return time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, torontohydro.Location).AddDate(0, 0, -days)
+}
 
-	log.Printf("Finished in %s\n", time.Since(start))
+// logFailures summarizes the days that could not be fetched.
+func logFailures(failures []failure) {
+	if len(failures) == 0 {
+		return
+	}
+	log.Printf("Could not fetch %d days:\n", len(failures))
+	for _, f := range failures {
+		log.Printf("  meter %s, %s [%s]\n", f.meter, f.day.Format("2006-01-02"), f.err.Error())
+	}
+}
+
+// fetchDays gets the consumptions of all days from date until endDate (excluding endDate).
+// Days are fetched concurrently by the configured number of workers, the consumptions are returned in time order.
+// Returns the consumptions, the last day of the uninterrupted sequence of done days starting at date
+// and the days that could not be fetched. A day is done once complete, days before settled are also done
+// if they are incomplete or have no data at all. Fetching stops once the context is cancelled or the login is rejected.
+func fetchDays(ctx context.Context, client *torontohydro.Client, meter torontohydro.Meter, date time.Time, endDate time.Time, settled time.Time) ([]*torontohydro.ElectricConsumption, time.Time, []failure) {
+	var days []time.Time
+	for ok := endDate.After(date); ok; ok = endDate.After(date) {
+		days = append(days, date)
+		date = date.AddDate(0, 0, 1)
+	}
+
+	// each worker stores its results at the index of the day
+	results := make([][]*torontohydro.ElectricConsumption, len(days))
+	errs := make([]error, len(days))
+	indexes := make(chan int)
+	// no further days are requested once the login was rejected, e.g. as the password changed
+	authFailed := make(chan struct{})
+	var authOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < config.TorontoHydro.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				start := time.Now()
+				results[index], errs[index] = client.GetData(ctx, meter, days[index])
+				metrics.ObservePhase("fetch_day", start)
+				if errors.Is(errs[index], torontohydro.ErrAuth) {
+					authOnce.Do(func() { close(authFailed) })
+				}
+			}
+		}()
+	}
+feed:
+	for index := range days {
+		select {
+		case <-authFailed:
+			break feed
+		default:
+		}
+		select {
+		case indexes <- index:
+		case <-ctx.Done():
+			break feed
+		case <-authFailed:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	var consumptions []*torontohydro.ElectricConsumption
+	var lastDay time.Time
+	var failures []failure
+	complete := true
+	for index, data := range results {
+		if errs[index] != nil && !errors.Is(errs[index], context.Canceled) {
+			failures = append(failures, failure{meter.MeterNumber, days[index], errs[index]})
+		}
+		consumptions = append(consumptions, data...)
+		done := isComplete(data) ||
+			days[index].Before(settled) && (errs[index] == nil || errors.Is(errs[index], torontohydro.ErrNotAvailable))
+		if complete && done {
+			lastDay = days[index]
+		} else {
+			complete = false
+		}
+	}
+
+	return consumptions, lastDay, failures
+}
+
+// isComplete tells if every row of the day has values, partly published days are fetched again.
+// The number of rows is not checked, e.g. the repeated hour of a fall back day might be missing.
+func isComplete(data []*torontohydro.ElectricConsumption) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for _, consumption := range data {
+		if !consumption.HasData() {
+			return false
+		}
+	}
+	return true
+}
+
+// createSinks creates the configured sinks, the prometheus sink is skipped unless its endpoint is served.
+func createSinks(serve bool) []sink.Sink {
+	var sinks []sink.Sink
+	for _, name := range config.Sinks {
+		switch name {
+		case "influxDB":
+			sinks = append(sinks, influxdb.NewSink(config))
+		case "prometheus":
+			if !serve {
+				log.Println("Skipping prometheus sink, its endpoint is only served by the exporter")
+				continue
+			}
+			sinks = append(sinks, prometheus.NewSink(config))
+		case "remoteWrite":
+			sinks = append(sinks, remotewrite.NewSink(config))
+		case "mqtt":
+			sinks = append(sinks, mqtt.NewSink(config))
+		case "postgres":
+			sinks = append(sinks, postgres.NewSink(config))
+		case "sqlite":
+			sqliteSink := sqlite.NewSink(config)
+			sinks = append(sinks, sqliteSink)
+			if config.SQLite.Dedup {
+				dedup = sqliteSink
+			}
+		default:
+			log.Fatalf("Unknown sink [%s]!\n", name)
+		}
+	}
+
+	return sinks
 }
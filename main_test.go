@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+const csvHeader = `Time,Usage TOU off-peak (kWh),Usage TOU mid-peak (kWh),Usage TOU on-peak (kWh),Usage tier 1 (kWh),Usage tier 2 (kWh),Usage ULO overnight (kWh),Usage ULO off-peak (kWh),Usage ULO mid-peak (kWh),Usage ULO on-peak (kWh),Cost TOU off-peak ($),Cost TOU mid-peak ($),Cost TOU on-peak ($),Cost tier 1 ($),Cost tier 2 ($),Cost ULO overnight ($),Cost ULO off-peak ($),Cost ULO mid-peak ($),Cost ULO on-peak ($)`
+
+// day returns the CSV of a day with the given hours since midnight, a negative usage leaves the row empty.
+func day(usages ...float64) string {
+	hours := make([]int, len(usages))
+	for i := range hours {
+		hours[i] = i
+	}
+	return rows(hours, usages)
+}
+
+// rows returns the CSV of the hours with the given usages, a negative usage leaves the row empty.
+func rows(hours []int, usages []float64) string {
+	var rows strings.Builder
+	rows.WriteString("2020/01/01 10:10:00 # Your hourly usage\n" + csvHeader)
+	for i, usage := range usages {
+		hour := hours[i]
+		label := fmt.Sprintf("%d a.m.", hour%12)
+		if hour%12 == 0 {
+			label = "12 a.m."
+		}
+		if hour >= 12 {
+			label = strings.Replace(label, "a.m.", "p.m.", 1)
+		}
+		if usage < 0 {
+			rows.WriteString("\n" + label + strings.Repeat(",", 18))
+		} else {
+			rows.WriteString(fmt.Sprintf("\n%s,,,,%.2f,,,,,,,,,0.01,,,,,", label, usage))
+		}
+	}
+	return rows.String()
+}
+
+// fullDay returns the CSV of a day with values in all of the given number of hours.
+func fullDay(hours int) string {
+	usages := make([]float64, hours)
+	for i := range usages {
+		usages[i] = 0.25
+	}
+	return day(usages...)
+}
+
+// portal serves the mock portal with the hourly data of the given days, other days fail with a server error.
+func portal(days map[string]string) *httptest.Server {
+	mock := torontohydro.MockHandler()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("p_p_resource_id") != "getHourlyChartData" {
+			mock.ServeHTTP(w, r)
+			return
+		}
+		data, ok := days[r.FormValue("date")]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+}
+
+// makeRange returns the numbers from first to last.
+func makeRange(first int, last int) []int {
+	var numbers []int
+	for i := first; i <= last; i++ {
+		numbers = append(numbers, i)
+	}
+	return numbers
+}
+
+func TestIsComplete(t *testing.T) {
+	value := func(v float32) *torontohydro.ElectricConsumption {
+		consumption := &torontohydro.ElectricConsumption{}
+		consumption.Set("UsageLowTier", v)
+		return consumption
+	}
+	tests := []struct {
+		name     string
+		data     []*torontohydro.ElectricConsumption
+		complete bool
+	}{
+		{"no rows", nil, false},
+		{"all rows with values", []*torontohydro.ElectricConsumption{value(0.2), value(0), value(-0.1)}, true},
+		{"empty row", []*torontohydro.ElectricConsumption{value(0.2), {}, value(0.3)}, false},
+	}
+	for _, test := range tests {
+		if got := isComplete(test.data); got != test.complete {
+			t.Errorf("%s: complete = %v, want %v", test.name, got, test.complete)
+		}
+	}
+}
+
+func TestFetchDays(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	config.TorontoHydro.Workers = 2
+
+	partial := make([]float64, 24)
+	partial[5] = -1
+	empty := []float64{-1, -1, -1}
+	// 1 a.m. is repeated when falling back
+	fallBack := rows(append([]int{0, 1, 1}, makeRange(2, 23)...), make([]float64, 25))
+	start := time.Date(2023, 11, 3, 0, 0, 0, 0, torontohydro.Location)
+	end := start.AddDate(0, 0, 4)
+	date := func(days int) time.Time {
+		return start.AddDate(0, 0, days)
+	}
+
+	tests := []struct {
+		name     string
+		days     map[string]string
+		settled  time.Time
+		lastDay  time.Time
+		hours    int
+		failures int
+	}{
+		{
+			name: "complete days including fall back day with 24 rows",
+			days: map[string]string{
+				"2023-11-03": fullDay(24), "2023-11-04": fullDay(24), "2023-11-05": fullDay(24), "2023-11-06": fullDay(24),
+			},
+			settled: start,
+			lastDay: date(3),
+			hours:   96,
+		},
+		{
+			name: "fall back day with 25 rows",
+			days: map[string]string{
+				"2023-11-03": fullDay(24), "2023-11-04": fullDay(24), "2023-11-05": fallBack, "2023-11-06": fullDay(24),
+			},
+			settled: start,
+			lastDay: date(3),
+			hours:   97,
+		},
+		{
+			name: "partial day within revision window",
+			days: map[string]string{
+				"2023-11-03": fullDay(24), "2023-11-04": day(partial...), "2023-11-05": fullDay(24), "2023-11-06": fullDay(24),
+			},
+			settled: start,
+			lastDay: date(0),
+			hours:   96,
+		},
+		{
+			name: "partial day settled",
+			days: map[string]string{
+				"2023-11-03": fullDay(24), "2023-11-04": day(partial...), "2023-11-05": fullDay(24), "2023-11-06": fullDay(24),
+			},
+			settled: end,
+			lastDay: date(3),
+			hours:   96,
+		},
+		{
+			name: "day without data within revision window",
+			days: map[string]string{
+				"2023-11-03": fullDay(24), "2023-11-04": day(empty...), "2023-11-05": fullDay(24), "2023-11-06": fullDay(24),
+			},
+			settled:  date(1),
+			lastDay:  date(0),
+			hours:    72,
+			failures: 1,
+		},
+		{
+			name: "day without data settled",
+			days: map[string]string{
+				"2023-11-03": fullDay(24), "2023-11-04": day(empty...), "2023-11-05": fullDay(24), "2023-11-06": fullDay(24),
+			},
+			settled:  end,
+			lastDay:  date(3),
+			hours:    72,
+			failures: 1,
+		},
+		{
+			name: "server error is fetched again even if settled",
+			days: map[string]string{
+				"2023-11-03": fullDay(24), "2023-11-05": fullDay(24), "2023-11-06": fullDay(24),
+			},
+			settled:  end,
+			lastDay:  date(0),
+			hours:    72,
+			failures: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := portal(test.days)
+			defer server.Close()
+			client := torontohydro.New("user", "secret")
+			client.BaseURL = server.URL
+			client.Logger = log.New(io.Discard, "", 0)
+			client.Retries = 0
+			if err := client.Login(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			consumptions, lastDay, failures := fetchDays(context.Background(), client, torontohydro.Meter{MeterNumber: "1234"}, start, end, test.settled)
+			if !lastDay.Equal(test.lastDay) {
+				t.Errorf("last day = %s, want %s", lastDay.Format("2006-01-02"), test.lastDay.Format("2006-01-02"))
+			}
+			if len(consumptions) != test.hours {
+				t.Errorf("got %d hours, want %d", len(consumptions), test.hours)
+			}
+			if len(failures) != test.failures {
+				t.Errorf("got %d failures, want %d", len(failures), test.failures)
+			}
+			for i := 1; i < len(consumptions); i++ {
+				if !consumptions[i].Time.After(consumptions[i-1].Time) {
+					t.Errorf("hour %d at %s not after previous hour", i, consumptions[i].Time)
+				}
+			}
+		})
+	}
+}
+
+func TestSettledBefore(t *testing.T) {
+	now := time.Date(2023, 6, 10, 1, 0, 0, 0, time.UTC) // June 9th in Toronto
+	for revisionDays, want := range map[int]string{0: "2023-06-08", 1: "2023-06-08", 3: "2023-06-06"} {
+		config.Checkpoint.RevisionDays = revisionDays
+		if got := settledBefore(now); got.Format("2006-01-02") != want || got.Hour() != 0 {
+			t.Errorf("revisionDays %d: settled before %s, want %s", revisionDays, got, want)
+		}
+	}
+	config.Checkpoint.RevisionDays = 0
+}
+
+func TestFetchDaysStopsOnRejectedLogin(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	config.TorontoHydro.Workers = 1
+
+	// session expires after the first login, logging in again is rejected
+	var logins, requests int32
+	mock := torontohydro.MockHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/log-in" && r.Method == "POST":
+			if atomic.AddInt32(&logins, 1) > 1 {
+				// the mock rejects this password
+				r.Form = url.Values{"_th_module_authentication_ThModuleAuthenticationPortlet_password": {"invalid"}}
+			}
+		case r.URL.Query().Get("p_p_resource_id") == "getHourlyChartData":
+			atomic.AddInt32(&requests, 1)
+			// without session cookie the mock answers with the login page
+			r.Header.Del("Cookie")
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := torontohydro.New("user", "secret")
+	client.BaseURL = server.URL
+	client.Logger = log.New(io.Discard, "", 0)
+	if err := client.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, torontohydro.Location)
+	_, lastDay, failures := fetchDays(context.Background(), client, torontohydro.Meter{MeterNumber: "1234"}, start, start.AddDate(1, 0, 0), start)
+	if !lastDay.IsZero() {
+		t.Errorf("last day = %s, want none", lastDay)
+	}
+	if len(failures) != 1 || !errors.Is(failures[0].err, torontohydro.ErrAuth) {
+		t.Errorf("failures = %v, want one ErrAuth", failures)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("requested %d days, want 1", got)
+	}
+	if got := atomic.LoadInt32(&logins); got != 2 {
+		t.Errorf("logged in %d times, want 2", got)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Registry holds the metrics about the exporter itself.
+var Registry = prom.NewRegistry()
+
+var (
+	phaseDuration = prom.NewHistogramVec(prom.HistogramOpts{
+		Name:    "toronto_hydro_exporter_phase_duration_seconds",
+		Help:    "Duration of the phases of an export (login, meters, fetch_day, export).",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"phase"})
+	requests = prom.NewCounterVec(prom.CounterOpts{
+		Name: "toronto_hydro_exporter_http_requests_total",
+		Help: "Requests sent to Toronto Hydro by endpoint and status code, code is empty if no response was received.",
+	}, []string{"endpoint", "code"})
+	requestDuration = prom.NewHistogramVec(prom.HistogramOpts{
+		Name:    "toronto_hydro_exporter_http_request_duration_seconds",
+		Help:    "Latency of requests sent to Toronto Hydro by endpoint.",
+		Buckets: prom.DefBuckets,
+	}, []string{"endpoint"})
+	pointsWritten = prom.NewCounterVec(prom.CounterOpts{
+		Name: "toronto_hydro_exporter_points_written_total",
+		Help: "Hourly consumptions written per sink.",
+	}, []string{"sink"})
+	pointsSkipped = prom.NewCounterVec(prom.CounterOpts{
+		Name: "toronto_hydro_exporter_points_skipped_total",
+		Help: "Hourly consumptions skipped per sink as they were already stored.",
+	}, []string{"sink"})
+	pointsRevised = prom.NewCounterVec(prom.CounterOpts{
+		Name: "toronto_hydro_exporter_points_revised_total",
+		Help: "Hourly consumptions overwritten per sink as Toronto Hydro revised them.",
+	}, []string{"sink"})
+	lastSuccess = prom.NewGaugeVec(prom.GaugeOpts{
+		Name: "toronto_hydro_exporter_last_success_timestamp_seconds",
+		Help: "Time of the last successful export per meter.",
+	}, []string{"meter", "account"})
+	lastRun = prom.NewGauge(prom.GaugeOpts{
+		Name: "toronto_hydro_exporter_last_run_timestamp_seconds",
+		Help: "Time the last export cycle finished.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(phaseDuration, requests, requestDuration, pointsWritten, pointsSkipped, pointsRevised, lastSuccess, lastRun)
+}
+
+// ObservePhase records the duration of a phase that started at the given time.
+func ObservePhase(phase string, start time.Time) {
+	phaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// PointsWritten counts consumptions written to the sink.
+func PointsWritten(sink string, count int) {
+	pointsWritten.WithLabelValues(sink).Add(float64(count))
+}
+
+// PointsSkipped counts consumptions not written to the sink as they already exist.
+func PointsSkipped(sink string, count int) {
+	pointsSkipped.WithLabelValues(sink).Add(float64(count))
+}
+
+// PointsRevised counts stored consumptions of the sink overwritten with revised values.
+func PointsRevised(sink string, count int) {
+	pointsRevised.WithLabelValues(sink).Add(float64(count))
+}
+
+// MeterExported records a successful export of the meter.
+func MeterExported(meter string, account string) {
+	lastSuccess.WithLabelValues(meter, account).SetToCurrentTime()
+}
+
+// RunFinished records the end of an export cycle.
+func RunFinished() {
+	lastRun.SetToCurrentTime()
+}
+
+// Transport instruments the requests sent by the round tripper.
+// The endpoint is the portal resource requested or the last element of the path.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		endpoint := req.URL.Query().Get("p_p_resource_id")
+		if len(endpoint) == 0 {
+			endpoint = path.Base(req.URL.Path)
+		}
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		requestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		code := ""
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		requests.WithLabelValues(endpoint, code).Inc()
+		return resp, err
+	})
+}
+
+type roundTripper func(req *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
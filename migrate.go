@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/influxdb"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+// migrate rewrites the InfluxDB points of all meters from an older schema or measurement to the configured ones.
+// Meters and their range are taken from the stored points, so Toronto Hydro is not contacted.
+func migrate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromSchema := flags.Int("from-schema", influxdb.SchemaLegacy, "schema of the existing points")
+	fromMeasurement := flags.String("from-measurement", config.InfluxDB.Measurement, "measurement of the existing points")
+	meterNumber := flags.String("meter", "", "only migrate this meter")
+	from := flags.String("from", "", "first day to migrate (YYYY-MM-DD), defaults to first stored point")
+	to := flags.String("to", "", "last day to migrate (YYYY-MM-DD), defaults to last stored point")
+	chunkDays := flags.Int("chunk", 30, "number of days migrated at once")
+	flags.Parse(args)
+
+	if len(config.InfluxDB.URL) == 0 {
+		return errors.New("influxDB is not configured")
+	}
+	if *fromSchema == config.InfluxDB.Schema && *fromMeasurement == config.InfluxDB.Measurement {
+		return errors.New("source and target are the same, set influxDB.schema or influxDB.measurement to the target")
+	}
+	if *chunkDays <= 0 {
+		return errors.New("chunk must be at least one day")
+	}
+
+	// existing points are read with the old layout and written with the configured one
+	sourceConfig := config
+	sourceConfig.InfluxDB.Schema = *fromSchema
+	sourceConfig.InfluxDB.Measurement = *fromMeasurement
+	source := influxdb.NewSink(sourceConfig)
+	defer source.Close()
+	target := influxdb.NewSink(config)
+	defer target.Close()
+
+	start := time.Now()
+	log.Printf("Migrating measurement %s schema %d to measurement %s schema %d\n", *fromMeasurement, *fromSchema, config.InfluxDB.Measurement, config.InfluxDB.Schema)
+	meters, err := source.Meters(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list meters [%s]", err.Error())
+	}
+
+	migrated := 0
+	for _, stored := range meters {
+		meter := stored.Meter
+		if len(*meterNumber) > 0 && meter.MeterNumber != *meterNumber {
+			continue
+		}
+		if stored.First.IsZero() || stored.Last.IsZero() {
+			continue
+		}
+
+		// range of the stored points, starting at midnight
+		first := stored.First.In(torontohydro.Location)
+		startDate := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, torontohydro.Location)
+		endDate := stored.Last.Add(time.Hour)
+		if len(*from) > 0 {
+			startDate, err = time.ParseInLocation("2006-01-02", *from, torontohydro.Location)
+			if err != nil {
+				return fmt.Errorf("invalid from date [%s]", *from)
+			}
+		}
+		if len(*to) > 0 {
+			endDate, err = time.ParseInLocation("2006-01-02", *to, torontohydro.Location)
+			if err != nil {
+				return fmt.Errorf("invalid to date [%s]", *to)
+			}
+			endDate = endDate.AddDate(0, 0, 1)
+		}
+		log.Printf("Migrating meter %s from %s until %s\n", meter.MeterNumber, startDate.Format("2006-01-02"), endDate.Add(-time.Second).Format("2006-01-02"))
+
+		for date := startDate; endDate.After(date); date = date.AddDate(0, 0, *chunkDays) {
+			if ctx.Err() != nil {
+				return fmt.Errorf("migration interrupted at %s, rerun with --from to resume", date.Format("2006-01-02"))
+			}
+			chunkEnd := date.AddDate(0, 0, *chunkDays)
+			if chunkEnd.After(endDate) {
+				chunkEnd = endDate
+			}
+
+			consumptions, err := source.Stored(ctx, meter, date, chunkEnd)
+			if err != nil {
+				return fmt.Errorf("could not read meter %s at %s [%s]", meter.MeterNumber, date.Format("2006-01-02"), err.Error())
+			}
+			if len(consumptions) == 0 {
+				continue
+			}
+			sort.Slice(consumptions, func(i, j int) bool {
+				return consumptions[i].Time.Before(consumptions[j].Time)
+			})
+			err = target.Write(ctx, meter, consumptions)
+			if err != nil {
+				return fmt.Errorf("could not write meter %s at %s [%s]", meter.MeterNumber, date.Format("2006-01-02"), err.Error())
+			}
+			migrated += len(consumptions)
+			log.Printf("Migrated meter %s until %s\n", meter.MeterNumber, chunkEnd.Add(-time.Second).Format("2006-01-02"))
+		}
+	}
+
+	log.Printf("Migrated %d hours in %s, points of the old layout are kept\n", migrated, time.Since(start))
+	return nil
+}
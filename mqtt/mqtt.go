@@ -0,0 +1,286 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+type Sink struct {
+	config     helpers.MQTT
+	client     paho.Client
+	mutex      sync.Mutex
+	discovered map[string]bool
+	states     map[string]*state
+}
+
+// state is published per meter, the totals accumulate all hours published since the first one.
+type state struct {
+	Time           string  `json:"time"`
+	HourlyUsage    float32 `json:"hourly_usage"`
+	HourlyCost     float32 `json:"hourly_cost"`
+	DailyUsage     float32 `json:"daily_usage"`
+	DailyCost      float32 `json:"daily_cost"`
+	DailyLastReset string  `json:"daily_last_reset"`
+	TotalUsage     float64 `json:"total_usage"`
+	TotalCost      float64 `json:"total_cost"`
+}
+
+type sensor struct {
+	key         string
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+	lastReset   string
+}
+
+type discovery struct {
+	Name              string `json:"name"`
+	UniqueID          string `json:"unique_id"`
+	ObjectID          string `json:"object_id"`
+	StateTopic        string `json:"state_topic"`
+	ValueTemplate     string `json:"value_template"`
+	UnitOfMeasurement string `json:"unit_of_measurement"`
+	DeviceClass       string `json:"device_class"`
+	StateClass        string `json:"state_class"`
+	LastResetTemplate string `json:"last_reset_value_template,omitempty"`
+	AvailabilityTopic string `json:"availability_topic"`
+	Device            device `json:"device"`
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// hourly and daily sensors reset at the start of their period, the total sensors are meant for the Energy dashboard.
+// Home Assistant only accepts state class total for monetary sensors, without last reset it is a cumulative total.
+var sensors = []sensor{
+	{"hourly_usage", "Hourly Usage", "kWh", "energy", "total", "{{ value_json.time }}"},
+	{"hourly_cost", "Hourly Cost", "CAD", "monetary", "total", "{{ value_json.time }}"},
+	{"daily_usage", "Daily Usage", "kWh", "energy", "total", "{{ value_json.daily_last_reset }}"},
+	{"daily_cost", "Daily Cost", "CAD", "monetary", "total", "{{ value_json.daily_last_reset }}"},
+	{"total_usage", "Total Usage", "kWh", "energy", "total_increasing", ""},
+	{"total_cost", "Total Cost", "CAD", "monetary", "total", ""},
+}
+
+func NewSink(config helpers.Config) *Sink {
+	s := &Sink{
+		config:     config.MQTT,
+		discovered: map[string]bool{},
+		states:     map[string]*state{},
+	}
+
+	options := paho.NewClientOptions().
+		AddBroker(config.MQTT.Broker).
+		SetClientID(config.MQTT.ClientID).
+		SetUsername(config.MQTT.Username).
+		SetPassword(string(config.MQTT.Password)).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(s.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(client paho.Client) {
+			log.Println("Connected to MQTT broker")
+			client.Publish(s.availabilityTopic(), 1, true, "online")
+			// broker might have lost retained discovery messages
+			s.mutex.Lock()
+			s.discovered = map[string]bool{}
+			s.mutex.Unlock()
+		})
+	s.client = paho.NewClient(options)
+	s.client.Connect()
+
+	return s
+}
+
+func (s *Sink) Name() string {
+	return "mqtt"
+}
+
+func (s *Sink) Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	// only the latest values are published, nothing to deduplicate
+	return nil, nil
+}
+
+func (s *Sink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+	if !s.client.IsConnectionOpen() {
+		return errors.New("not connected to MQTT broker")
+	}
+
+	s.mutex.Lock()
+	discovered := s.discovered[meter.MeterNumber]
+	s.mutex.Unlock()
+	if !discovered {
+		err := s.publishDiscovery(ctx, meter)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.discovered[meter.MeterNumber] = true
+		s.mutex.Unlock()
+	}
+
+	s.mutex.Lock()
+	current, ok := s.states[meter.MeterNumber]
+	s.mutex.Unlock()
+	if !ok {
+		// continue the totals of the state retained by the broker
+		current = s.restore(ctx, meter)
+		s.mutex.Lock()
+		s.states[meter.MeterNumber] = current
+		s.mutex.Unlock()
+	}
+
+	// consumptions are sorted by time, hours up to the latest one published are already counted
+	latest, _ := time.Parse(time.RFC3339, current.Time)
+	added := 0
+	for _, consumption := range consumptions {
+		if !consumption.HasData() || !consumption.Time.After(latest) {
+			continue
+		}
+		year, month, day := consumption.Time.In(torontohydro.Location).Date()
+		midnight := time.Date(year, month, day, 0, 0, 0, 0, torontohydro.Location).Format(time.RFC3339)
+		if midnight != current.DailyLastReset {
+			current.DailyUsage = 0
+			current.DailyCost = 0
+			current.DailyLastReset = midnight
+		}
+
+		usage, cost := sum(consumption, "usage"), sum(consumption, "cost")
+		current.Time = consumption.Time.Format(time.RFC3339)
+		current.HourlyUsage = usage
+		current.HourlyCost = cost
+		current.DailyUsage += usage
+		current.DailyCost += cost
+		current.TotalUsage += float64(usage)
+		current.TotalCost += float64(cost)
+		latest = consumption.Time
+		added++
+	}
+	if added == 0 {
+		log.Printf("No hours after %s for meter %s, skip publishing state\n", current.Time, meter.MeterNumber)
+		return nil
+	}
+
+	payload, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	log.Printf("Publishing state of meter %s for %s\n", meter.MeterNumber, current.Time)
+	return s.publish(ctx, s.stateTopic(meter), payload)
+}
+
+func (s *Sink) Close() {
+	s.client.Publish(s.availabilityTopic(), 1, true, "offline").WaitTimeout(5 * time.Second)
+	s.client.Disconnect(250)
+}
+
+func (s *Sink) publishDiscovery(ctx context.Context, meter torontohydro.Meter) error {
+	deviceName := "Toronto Hydro Meter " + meter.MeterNumber
+	if len(meter.Account) > 0 {
+		deviceName = "Toronto Hydro " + meter.Account + " Meter " + meter.MeterNumber
+	}
+	for _, sensor := range sensors {
+		id := "toronto_hydro_" + meter.MeterNumber + "_" + sensor.key
+		payload, err := json.Marshal(discovery{
+			Name:              sensor.name,
+			UniqueID:          id,
+			ObjectID:          id,
+			StateTopic:        s.stateTopic(meter),
+			ValueTemplate:     "{{ value_json." + sensor.key + " }}",
+			UnitOfMeasurement: sensor.unit,
+			DeviceClass:       sensor.deviceClass,
+			StateClass:        sensor.stateClass,
+			LastResetTemplate: sensor.lastReset,
+			AvailabilityTopic: s.availabilityTopic(),
+			Device: device{
+				Identifiers:  []string{"toronto_hydro_" + meter.MeterNumber},
+				Name:         deviceName,
+				Manufacturer: "Toronto Hydro",
+				Model:        "Smart Meter",
+			},
+		})
+		if err != nil {
+			return err
+		}
+		topic := fmt.Sprintf("%s/sensor/toronto_hydro_%s/%s/config", s.config.DiscoveryPrefix, meter.MeterNumber, sensor.key)
+		err = s.publish(ctx, topic, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore returns the state retained by the broker for the meter, or an empty state if there is none.
+func (s *Sink) restore(ctx context.Context, meter torontohydro.Meter) *state {
+	payloads := make(chan []byte, 1)
+	token := s.client.Subscribe(s.stateTopic(meter), 1, func(client paho.Client, message paho.Message) {
+		select {
+		case payloads <- message.Payload():
+		default:
+		}
+	})
+	defer s.client.Unsubscribe(s.stateTopic(meter))
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		log.Printf("Error restoring state of meter %s, totals start at zero!\n", meter.MeterNumber)
+		return &state{}
+	}
+
+	// retained messages are delivered right after subscribing
+	restored := &state{}
+	select {
+	case payload := <-payloads:
+		err := json.Unmarshal(payload, restored)
+		if err != nil {
+			log.Printf("Error restoring state of meter %s [%s]!\n", meter.MeterNumber, err.Error())
+			return &state{}
+		}
+		log.Printf("Restored state of meter %s for %s\n", meter.MeterNumber, restored.Time)
+	case <-time.After(2 * time.Second):
+	case <-ctx.Done():
+	}
+	return restored
+}
+
+func (s *Sink) publish(ctx context.Context, topic string, payload []byte) error {
+	token := s.client.Publish(topic, 1, true, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(10 * time.Second):
+		return errors.New("timeout publishing to " + topic)
+	}
+}
+
+func (s *Sink) stateTopic(meter torontohydro.Meter) string {
+	return s.config.TopicPrefix + "/" + meter.MeterNumber + "/state"
+}
+
+func (s *Sink) availabilityTopic() string {
+	return s.config.TopicPrefix + "/status"
+}
+
+func sum(consumption *torontohydro.ElectricConsumption, kind string) float32 {
+	var total float32
+	for _, field := range consumption.Fields() {
+		if field.Kind == kind && field.Value != nil {
+			total += *field.Value
+		}
+	}
+	return total
+}
@@ -0,0 +1,294 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeClient keeps published messages in memory and delivers retained ones on subscribe.
+type fakeClient struct {
+	paho.Client
+	mutex     sync.Mutex
+	retained  map[string][]byte
+	published map[string]int
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{retained: map[string][]byte{}, published: map[string]int{}}
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	return true
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.published[topic]++
+	if retained {
+		switch payload := payload.(type) {
+		case []byte:
+			c.retained[topic] = payload
+		case string:
+			c.retained[topic] = []byte(payload)
+		}
+	}
+	return doneToken()
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	c.mutex.Lock()
+	payload, ok := c.retained[topic]
+	c.mutex.Unlock()
+	if ok {
+		callback(c, fakeMessage{payload: payload})
+	}
+	return doneToken()
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) paho.Token {
+	return doneToken()
+}
+
+func (c *fakeClient) state(t *testing.T, topic string) state {
+	t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var current state
+	if err := json.Unmarshal(c.retained[topic], &current); err != nil {
+		t.Fatal(err)
+	}
+	return current
+}
+
+type fakeMessage struct {
+	paho.Message
+	payload []byte
+}
+
+func (m fakeMessage) Payload() []byte {
+	return m.payload
+}
+
+type fakeToken struct {
+	done chan struct{}
+}
+
+func doneToken() paho.Token {
+	token := fakeToken{done: make(chan struct{})}
+	close(token.done)
+	return token
+}
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t fakeToken) Done() <-chan struct{}          { return t.done }
+func (t fakeToken) Error() error                   { return nil }
+
+func newTestSink(client paho.Client) *Sink {
+	return &Sink{
+		config:     helpers.MQTT{TopicPrefix: "toronto_hydro", DiscoveryPrefix: "homeassistant"},
+		client:     client,
+		discovered: map[string]bool{},
+		states:     map[string]*state{},
+	}
+}
+
+// hour returns a consumption at the hour of 2022-01-02, negative hours belong to the day before.
+func hour(h int, usage float32, cost float32) *torontohydro.ElectricConsumption {
+	consumption := &torontohydro.ElectricConsumption{Time: time.Date(2022, 1, 2, h, 0, 0, 0, torontohydro.Location)}
+	// usage and cost are split across periods
+	consumption.Set("UsageTOUOffPeak", usage/2)
+	consumption.Set("UsageTOUOnPeak", usage/2)
+	consumption.Set("CostTOUOffPeak", cost)
+	return consumption
+}
+
+func near(got float64, want float64) bool {
+	return math.Abs(got-want) < 0.0001
+}
+
+func TestWrite(t *testing.T) {
+	client := newFakeClient()
+	sink := newTestSink(client)
+	meter := torontohydro.Meter{MeterNumber: "1234"}
+	topic := "toronto_hydro/1234/state"
+
+	// totals continue from the retained state
+	retained, _ := json.Marshal(state{
+		Time:           hour(-2, 0, 0).Time.Format(time.RFC3339),
+		DailyUsage:     5,
+		DailyCost:      0.5,
+		DailyLastReset: "2022-01-01T00:00:00-05:00",
+		TotalUsage:     100,
+		TotalCost:      10,
+	})
+	client.retained[topic] = retained
+
+	// hours up to the retained one are already counted, the daily sums reset at midnight
+	err := sink.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{hour(-3, 1, 0.1), hour(-2, 1, 0.1), hour(-1, 1, 0.1), hour(0, 2, 0.2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := client.state(t, topic)
+	if current.Time != "2022-01-02T00:00:00-05:00" || current.DailyLastReset != "2022-01-02T00:00:00-05:00" {
+		t.Errorf("time = %s, daily last reset = %s, want midnight", current.Time, current.DailyLastReset)
+	}
+	if !near(float64(current.HourlyUsage), 2) || !near(float64(current.HourlyCost), 0.2) {
+		t.Errorf("hourly = %v, %v, want 2, 0.2", current.HourlyUsage, current.HourlyCost)
+	}
+	if !near(float64(current.DailyUsage), 2) || !near(float64(current.DailyCost), 0.2) {
+		t.Errorf("daily = %v, %v, want 2, 0.2", current.DailyUsage, current.DailyCost)
+	}
+	if !near(current.TotalUsage, 103) || !near(current.TotalCost, 10.3) {
+		t.Errorf("total = %v, %v, want 103, 10.3", current.TotalUsage, current.TotalCost)
+	}
+
+	// fetching the same hours again publishes nothing
+	err = sink.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{hour(-1, 1, 0.1), hour(0, 2, 0.2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published := client.published[topic]; published != 1 {
+		t.Errorf("state published %d times, want 1", published)
+	}
+
+	// hours without data are not counted
+	empty := &torontohydro.ElectricConsumption{Time: hour(1, 0, 0).Time}
+	err = sink.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{empty, hour(2, 0.5, 0.05)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current = client.state(t, topic)
+	if current.Time != "2022-01-02T02:00:00-05:00" {
+		t.Errorf("time = %s, want 02:00", current.Time)
+	}
+	if !near(float64(current.DailyUsage), 2.5) || !near(current.TotalUsage, 103.5) || !near(current.TotalCost, 10.35) {
+		t.Errorf("daily usage = %v, total = %v, %v, want 2.5, 103.5, 10.35", current.DailyUsage, current.TotalUsage, current.TotalCost)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	client := newFakeClient()
+	sink := newTestSink(client)
+	meter := torontohydro.Meter{MeterNumber: "1234", Account: "home"}
+	client.retained["toronto_hydro/1234/state"] = []byte(`{}`)
+
+	err := sink.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{hour(0, 1, 0.1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]struct {
+		stateClass string
+		lastReset  string
+	}{
+		"hourly_usage": {"total", "{{ value_json.time }}"},
+		"hourly_cost":  {"total", "{{ value_json.time }}"},
+		"daily_usage":  {"total", "{{ value_json.daily_last_reset }}"},
+		"daily_cost":   {"total", "{{ value_json.daily_last_reset }}"},
+		"total_usage":  {"total_increasing", ""},
+		"total_cost":   {"total", ""},
+	}
+	for key, sensor := range want {
+		payload, ok := client.retained["homeassistant/sensor/toronto_hydro_1234/"+key+"/config"]
+		if !ok {
+			t.Errorf("no discovery config for %s", key)
+			continue
+		}
+		var config map[string]interface{}
+		if err := json.Unmarshal(payload, &config); err != nil {
+			t.Fatal(err)
+		}
+		if config["state_class"] != sensor.stateClass {
+			t.Errorf("%s: state class = %v, want %s", key, config["state_class"], sensor.stateClass)
+		}
+		lastReset, ok := config["last_reset_value_template"]
+		if len(sensor.lastReset) == 0 && ok {
+			t.Errorf("%s: last reset template = %v, want none", key, lastReset)
+		}
+		if len(sensor.lastReset) > 0 && lastReset != sensor.lastReset {
+			t.Errorf("%s: last reset template = %v, want %s", key, lastReset, sensor.lastReset)
+		}
+		if config["state_topic"] != "toronto_hydro/1234/state" || config["value_template"] != "{{ value_json."+key+" }}" {
+			t.Errorf("%s: state topic = %v, value template = %v", key, config["state_topic"], config["value_template"])
+		}
+		if device := config["device"].(map[string]interface{}); device["name"] != "Toronto Hydro home Meter 1234" {
+			t.Errorf("%s: device name = %v", key, device["name"])
+		}
+	}
+
+	// discovery is only published once
+	err = sink.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{hour(1, 1, 0.1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published := client.published["homeassistant/sensor/toronto_hydro_1234/total_usage/config"]; published != 1 {
+		t.Errorf("discovery published %d times, want 1", published)
+	}
+}
+
+// TestBroker runs against the broker given by MQTT_TEST_BROKER, e.g. tcp://localhost:1883, its retained messages are removed afterwards.
+func TestBroker(t *testing.T) {
+	broker := os.Getenv("MQTT_TEST_BROKER")
+	if len(broker) == 0 {
+		t.Skip("MQTT_TEST_BROKER not set")
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+	var config helpers.Config
+	config.MQTT = helpers.MQTT{
+		Broker:          broker,
+		ClientID:        "toronto-hydro-test-" + id,
+		TopicPrefix:     "toronto_hydro_test_" + id,
+		DiscoveryPrefix: "toronto_hydro_test_" + id + "_discovery",
+	}
+	meter := torontohydro.Meter{MeterNumber: "1234"}
+	connect := func() *Sink {
+		sink := NewSink(config)
+		for i := 0; i < 100 && !sink.client.IsConnectionOpen(); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return sink
+	}
+
+	sink := connect()
+	defer func() {
+		for _, topic := range []string{sink.stateTopic(meter), sink.availabilityTopic()} {
+			sink.client.Publish(topic, 1, true, []byte{}).WaitTimeout(5 * time.Second)
+		}
+		for _, sensor := range sensors {
+			topic := config.MQTT.DiscoveryPrefix + "/sensor/toronto_hydro_1234/" + sensor.key + "/config"
+			sink.client.Publish(topic, 1, true, []byte{}).WaitTimeout(5 * time.Second)
+		}
+		sink.client.Disconnect(250)
+	}()
+	err := sink.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{hour(0, 1, 0.1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted sink continues the totals retained by the broker
+	config.MQTT.ClientID += "-restarted"
+	restarted := connect()
+	defer restarted.Close()
+	err = restarted.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{hour(0, 1, 0.1), hour(1, 2, 0.2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := restarted.states[meter.MeterNumber]
+	if !near(current.TotalUsage, 3) || !near(current.TotalCost, 0.3) || !strings.HasPrefix(current.Time, "2022-01-02T01:00") {
+		t.Errorf("state = %+v, want totals of both hours", current)
+	}
+}
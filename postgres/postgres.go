@@ -0,0 +1,202 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// rows per insert statement, postgres allows at most 65535 parameters
+const batchSize = 500
+
+type Sink struct {
+	pool *pgxpool.Pool
+}
+
+func NewSink(config helpers.Config) *Sink {
+	pool, err := pgxpool.New(context.Background(), string(config.Postgres.URL))
+	if err != nil {
+		log.Fatalf("Error connecting to PostgreSQL [%s]!\n", err.Error())
+	}
+
+	_, err = pool.Exec(context.Background(), schema())
+	if err != nil {
+		log.Fatalf("Error creating PostgreSQL schema [%s]!\n", err.Error())
+	}
+
+	if config.Postgres.TimescaleDB {
+		_, err = pool.Exec(context.Background(), `SELECT create_hypertable('consumption', 'time', if_not_exists => TRUE)`)
+		if err != nil {
+			log.Fatalf("Error creating TimescaleDB hypertable [%s]!\n", err.Error())
+		}
+	}
+
+	return &Sink{
+		pool: pool,
+	}
+}
+
+func (s *Sink) Name() string {
+	return "postgres"
+}
+
+func (s *Sink) Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	rows, err := s.pool.Query(ctx, `SELECT time FROM consumption WHERE meter = $1 AND time >= $2 AND time < $3`,
+		meter.MeterNumber, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timestamps []time.Time
+	for rows.Next() {
+		var timestamp time.Time
+		err = rows.Scan(&timestamp)
+		if err != nil {
+			return nil, err
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	return timestamps, rows.Err()
+}
+
+// Stored returns the consumptions stored for the meter, used to detect revised hours.
+func (s *Sink) Stored(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]*torontohydro.ElectricConsumption, error) {
+	rows, err := s.pool.Query(ctx, `SELECT time, `+strings.Join(columns(), ", ")+` FROM consumption WHERE meter = $1 AND time >= $2 AND time < $3`,
+		meter.MeterNumber, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := (&torontohydro.ElectricConsumption{}).Fields()
+	var consumptions []*torontohydro.ElectricConsumption
+	for rows.Next() {
+		consumption := &torontohydro.ElectricConsumption{}
+		values := make([]*float32, len(fields))
+		dest := []interface{}{&consumption.Time}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		for i, field := range fields {
+			if values[i] != nil {
+				consumption.Set(field.Name, *values[i])
+			}
+		}
+		consumptions = append(consumptions, consumption)
+	}
+	return consumptions, rows.Err()
+}
+
+func (s *Sink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// upsert meter
+	tags, err := json.Marshal(meter.Tags)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO meters (meter, service_point_id, start_date, end_date, account, tags) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (meter) DO UPDATE SET service_point_id = excluded.service_point_id, start_date = excluded.start_date, end_date = excluded.end_date,
+		account = excluded.account, tags = excluded.tags`,
+		meter.MeterNumber, meter.Id, meter.StartDate, meter.EndDate, meter.Account, string(tags))
+	if err != nil {
+		return err
+	}
+
+	// hours without any value are not stored, so they are fetched again once published
+	var withData []*torontohydro.ElectricConsumption
+	for _, consumption := range consumptions {
+		if consumption.HasData() {
+			withData = append(withData, consumption)
+		}
+	}
+
+	// upsert consumptions with multi-row inserts
+	for start := 0; start < len(withData); start += batchSize {
+		end := start + batchSize
+		if end > len(withData) {
+			end = len(withData)
+		}
+		query, args := upsert(meter, withData[start:end])
+		_, err = tx.Exec(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Stored %d hours of meter %s in PostgreSQL\n", len(withData), meter.MeterNumber)
+	return tx.Commit(ctx)
+}
+
+func (s *Sink) Close() {
+	s.pool.Close()
+}
+
+func upsert(meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) (string, []interface{}) {
+	columns := columns()
+	updates := make([]string, len(columns))
+	for i, column := range columns {
+		updates[i] = column + " = excluded." + column
+	}
+
+	var values []string
+	var args []interface{}
+	for _, consumption := range consumptions {
+		row := []interface{}{meter.MeterNumber, consumption.Time}
+		for _, field := range consumption.Fields() {
+			row = append(row, field.Value)
+		}
+		placeholders := make([]string, len(row))
+		for i := range row {
+			placeholders[i] = "$" + strconv.Itoa(len(args)+i+1)
+		}
+		values = append(values, "("+strings.Join(placeholders, ", ")+")")
+		args = append(args, row...)
+	}
+
+	return `INSERT INTO consumption (meter, time, ` + strings.Join(columns, ", ") + `) VALUES ` + strings.Join(values, ", ") +
+		` ON CONFLICT (meter, time) DO UPDATE SET ` + strings.Join(updates, ", "), args
+}
+
+// columns returns the consumption columns, e.g. usage_tou_on_peak, in the order of ElectricConsumption.Fields.
+func columns() []string {
+	var columns []string
+	for _, field := range (&torontohydro.ElectricConsumption{}).Fields() {
+		columns = append(columns, field.Key())
+	}
+	return columns
+}
+
+func schema() string {
+	return `CREATE TABLE IF NOT EXISTS meters (
+		meter TEXT PRIMARY KEY,
+		service_point_id TEXT,
+		start_date DATE,
+		end_date DATE
+	);
+	ALTER TABLE meters ADD COLUMN IF NOT EXISTS account TEXT;
+	ALTER TABLE meters ADD COLUMN IF NOT EXISTS tags JSONB;
+	CREATE TABLE IF NOT EXISTS consumption (
+		meter TEXT NOT NULL REFERENCES meters (meter),
+		time TIMESTAMPTZ NOT NULL,
+		` + strings.Join(columns(), " REAL,\n\t\t") + ` REAL,
+		PRIMARY KEY (meter, time)
+	);`
+}
@@ -0,0 +1,128 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+// hours returns count hourly consumptions, every other hour without cost.
+func hours(count int) []*torontohydro.ElectricConsumption {
+	var consumptions []*torontohydro.ElectricConsumption
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, torontohydro.Location)
+	for i := 0; i < count; i++ {
+		consumption := &torontohydro.ElectricConsumption{Time: start.Add(time.Duration(i) * time.Hour)}
+		consumption.Set("UsageTOUOffPeak", 0.5)
+		if i%2 == 0 {
+			consumption.Set("CostTOUOffPeak", 0.04)
+		}
+		consumptions = append(consumptions, consumption)
+	}
+	return consumptions
+}
+
+func TestUpsert(t *testing.T) {
+	meter := torontohydro.Meter{MeterNumber: "1234"}
+	consumptions := hours(batchSize)
+	query, args := upsert(meter, consumptions)
+
+	perRow := 2 + len(columns())
+	if len(args) != batchSize*perRow {
+		t.Fatalf("%d args, want %d", len(args), batchSize*perRow)
+	}
+	if len(args) > 65535 {
+		t.Errorf("%d args exceed the PostgreSQL limit", len(args))
+	}
+
+	// placeholders are numbered without gaps in the order of the args
+	placeholders := regexp.MustCompile(`\$(\d+)`).FindAllStringSubmatch(query, -1)
+	if len(placeholders) != len(args) {
+		t.Fatalf("%d placeholders, want %d", len(placeholders), len(args))
+	}
+	for i, placeholder := range placeholders {
+		if number, _ := strconv.Atoi(placeholder[1]); number != i+1 {
+			t.Fatalf("placeholder %d is $%d", i+1, number)
+		}
+	}
+	if rows := strings.Count(query, "), ("); rows != batchSize-1 {
+		t.Errorf("%d rows in query, want %d", rows+1, batchSize)
+	}
+
+	// each row starts with meter and time, followed by the values in the order of the columns
+	last := args[(batchSize-1)*perRow:]
+	if last[0] != "1234" || last[1] != consumptions[batchSize-1].Time {
+		t.Errorf("last row starts with %v, %v", last[0], last[1])
+	}
+	for i, field := range consumptions[batchSize-1].Fields() {
+		if value := last[2+i].(*float32); value != field.Value {
+			t.Errorf("value %d of last row is not %s", i, field.Name)
+		}
+	}
+}
+
+// TestSink runs against the database given by POSTGRES_TEST_URL, its test meter is removed afterwards.
+func TestSink(t *testing.T) {
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if len(url) == 0 {
+		t.Skip("POSTGRES_TEST_URL not set")
+	}
+	var config helpers.Config
+	config.Postgres.URL = helpers.Secret(url)
+	sink := NewSink(config)
+	defer sink.Close()
+
+	ctx := context.Background()
+	meter := torontohydro.Meter{MeterNumber: "test-" + strconv.FormatInt(time.Now().UnixNano(), 36), Account: "home"}
+	defer func() {
+		sink.pool.Exec(ctx, `DELETE FROM consumption WHERE meter = $1`, meter.MeterNumber)
+		sink.pool.Exec(ctx, `DELETE FROM meters WHERE meter = $1`, meter.MeterNumber)
+	}()
+
+	// more hours than fit into a batch, plus one without data
+	consumptions := hours(2*batchSize + 1)
+	empty := &torontohydro.ElectricConsumption{Time: consumptions[len(consumptions)-1].Time.Add(time.Hour)}
+	err := sink.Write(ctx, meter, append(consumptions, empty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := consumptions[0].Time
+	end := empty.Time.Add(time.Hour)
+	existing, err := sink.Existing(ctx, meter, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(existing) != len(consumptions) {
+		t.Errorf("%d hours stored, want %d", len(existing), len(consumptions))
+	}
+
+	// overwrite the first hour
+	consumptions[0].Set("UsageTOUOffPeak", 0.7)
+	err = sink.Write(ctx, meter, consumptions[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := sink.Stored(ctx, meter, start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("%d hours stored in range, want 2", len(stored))
+	}
+	for _, consumption := range stored {
+		switch {
+		case consumption.Time.Equal(start):
+			if *consumption.UsageTOUOffPeak != 0.7 {
+				t.Errorf("usage = %v, want 0.7", *consumption.UsageTOUOffPeak)
+			}
+		case consumption.CostTOUOffPeak != nil:
+			t.Errorf("cost = %v, want NULL", *consumption.CostTOUOffPeak)
+		}
+	}
+}
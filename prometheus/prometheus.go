@@ -0,0 +1,138 @@
+package prometheus
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/metrics"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Sink struct {
+	labels     []string
+	usage      *prom.GaugeVec
+	cost       *prom.GaugeVec
+	usageTotal *prom.CounterVec
+	costTotal  *prom.CounterVec
+	timestamp  *prom.GaugeVec
+	server     *http.Server
+
+	// latest exported consumption per meter, prevents counting an hour twice
+	mutex  sync.Mutex
+	latest map[string]time.Time
+}
+
+func NewSink(config helpers.Config) *Sink {
+	// account and tags of all accounts are added as labels
+	labels := append([]string{"meter", "plan", "period", "account"}, config.TorontoHydro.TagKeys()...)
+	s := &Sink{
+		labels: labels,
+		usage: prom.NewGaugeVec(prom.GaugeOpts{
+			Name: "toronto_hydro_usage_kwh",
+			Help: "Energy usage of the latest exported hour in kWh.",
+		}, labels),
+		cost: prom.NewGaugeVec(prom.GaugeOpts{
+			Name: "toronto_hydro_cost_dollars",
+			Help: "Cost of the latest exported hour in dollars.",
+		}, labels),
+		usageTotal: prom.NewCounterVec(prom.CounterOpts{
+			Name: "toronto_hydro_usage_kwh_total",
+			Help: "Energy usage exported since start in kWh.",
+		}, labels),
+		costTotal: prom.NewCounterVec(prom.CounterOpts{
+			Name: "toronto_hydro_cost_dollars_total",
+			Help: "Cost exported since start in dollars.",
+		}, labels),
+		timestamp: prom.NewGaugeVec(prom.GaugeOpts{
+			Name: "toronto_hydro_latest_timestamp_seconds",
+			Help: "Timestamp of the latest exported hour.",
+		}, append([]string{"meter", "account"}, config.TorontoHydro.TagKeys()...)),
+		latest: map[string]time.Time{},
+	}
+
+	registry := prom.NewRegistry()
+	registry.MustRegister(s.usage, s.cost, s.usageTotal, s.costTotal, s.timestamp)
+
+	mux := http.NewServeMux()
+	// metrics about the exporter itself are served alongside
+	mux.Handle("/metrics", promhttp.HandlerFor(prom.Gatherers{registry, metrics.Registry}, promhttp.HandlerOpts{}))
+	s.server = &http.Server{
+		Addr:    config.Prometheus.Address,
+		Handler: mux,
+	}
+
+	go func() {
+		log.Printf("Serving Prometheus metrics on %s/metrics\n", config.Prometheus.Address)
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error serving Prometheus metrics [%s]!\n", err.Error())
+		}
+	}()
+
+	return s
+}
+
+func (s *Sink) Name() string {
+	return "prometheus"
+}
+
+func (s *Sink) Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	// metrics are kept in memory only, older hours are skipped when writing
+	return nil, nil
+}
+
+func (s *Sink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// label values of the meter, followed by plan and period of each field
+	meterLabels := meter.Labels()
+	values := func(field torontohydro.Field) []string {
+		values := []string{meter.MeterNumber, field.Plan, field.Period}
+		for _, label := range s.labels[3:] {
+			values = append(values, meterLabels[label])
+		}
+		return values
+	}
+
+	latest := s.latest[meter.MeterNumber]
+	for _, consumption := range consumptions {
+		if !consumption.Time.After(latest) {
+			continue
+		}
+		latest = consumption.Time
+
+		for _, field := range consumption.Fields() {
+			if field.Value == nil {
+				continue
+			}
+			gauge, counter := s.usage, s.usageTotal
+			if field.Kind == "cost" {
+				gauge, counter = s.cost, s.costTotal
+			}
+			gauge.WithLabelValues(values(field)...).Set(float64(*field.Value))
+			// counters must not decrease, negative hours only show in the gauge
+			if *field.Value > 0 {
+				counter.WithLabelValues(values(field)...).Add(float64(*field.Value))
+			}
+		}
+	}
+
+	s.latest[meter.MeterNumber] = latest
+	timestampValues := []string{meter.MeterNumber}
+	for _, label := range s.labels[3:] {
+		timestampValues = append(timestampValues, meterLabels[label])
+	}
+	s.timestamp.WithLabelValues(timestampValues...).Set(float64(latest.Unix()))
+	return nil
+}
+
+func (s *Sink) Close() {
+	s.server.Close()
+}
@@ -0,0 +1,155 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type Sink struct {
+	config helpers.RemoteWrite
+	client http.Client
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type series struct {
+	labels  []label
+	samples []sample
+}
+
+func NewSink(config helpers.Config) *Sink {
+	return &Sink{
+		config: config.RemoteWrite,
+		client: http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (s *Sink) Name() string {
+	return "remoteWrite"
+}
+
+func (s *Sink) Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	// remote write can't be queried, receivers are expected to deduplicate identical samples
+	return nil, nil
+}
+
+func (s *Sink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+
+	// one series per field, samples are kept in time order
+	var keys []string
+	allSeries := map[string]*series{}
+	for _, consumption := range consumptions {
+		for _, field := range consumption.Fields() {
+			if field.Value == nil {
+				continue
+			}
+			current, ok := allSeries[field.Name]
+			if !ok {
+				name := "toronto_hydro_usage_kwh"
+				if field.Kind == "cost" {
+					name = "toronto_hydro_cost_dollars"
+				}
+				current = &series{
+					labels: []label{
+						{"__name__", name},
+						{"meter", meter.MeterNumber},
+						{"period", field.Period},
+						{"plan", field.Plan},
+					},
+				}
+				for key, value := range meter.Labels() {
+					current.labels = append(current.labels, label{key, value})
+				}
+				// labels must be sorted by name
+				sort.Slice(current.labels, func(i, j int) bool {
+					return current.labels[i].name < current.labels[j].name
+				})
+				allSeries[field.Name] = current
+				keys = append(keys, field.Name)
+			}
+			current.samples = append(current.samples, sample{float64(*field.Value), consumption.Time.UnixMilli()})
+		}
+	}
+
+	log.Printf("Sending %d hours to remote write endpoint\n", len(consumptions))
+
+	// encode as snappy compressed protobuf write request
+	var request []byte
+	for _, key := range keys {
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encodeSeries(allSeries[key]))
+	}
+	body := snappy.Encode(nil, request)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if len(s.config.Username) > 0 {
+		req.SetBasicAuth(s.config.Username, string(s.config.Password))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("remote write failed with status code [%d]: %s", resp.StatusCode, message)
+	}
+
+	return nil
+}
+
+func (s *Sink) Close() {
+	s.client.CloseIdleConnections()
+}
+
+func encodeSeries(series *series) []byte {
+	var b []byte
+	for _, label := range series.labels {
+		var l []byte
+		l = protowire.AppendTag(l, 1, protowire.BytesType)
+		l = protowire.AppendString(l, label.name)
+		l = protowire.AppendTag(l, 2, protowire.BytesType)
+		l = protowire.AppendString(l, label.value)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, l)
+	}
+	for _, sample := range series.samples {
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sample.timestamp))
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, s)
+	}
+	return b
+}
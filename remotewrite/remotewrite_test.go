@@ -0,0 +1,135 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// receiver decodes the write requests sent to it.
+type receiver struct {
+	requests []prompb.WriteRequest
+	headers  http.Header
+	status   int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.headers = req.Header
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request prompb.WriteRequest
+	if err := request.Unmarshal(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.requests = append(r.requests, request)
+	if r.status != 0 {
+		http.Error(w, "rejected", r.status)
+	}
+}
+
+func newTestSink(url string) *Sink {
+	var config helpers.Config
+	config.RemoteWrite.URL = url
+	config.RemoteWrite.Username = "user"
+	config.RemoteWrite.Password = "secret"
+	return NewSink(config)
+}
+
+func TestWrite(t *testing.T) {
+	receiver := &receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sink := newTestSink(server.URL)
+	defer sink.Close()
+
+	first := &torontohydro.ElectricConsumption{Time: time.Date(2022, 11, 6, 0, 0, 0, 0, torontohydro.Location)}
+	first.Set("UsageTOUOffPeak", 0.5)
+	first.Set("CostTOUOffPeak", 0.04)
+	// empty cells are not sent, zero values are
+	second := &torontohydro.ElectricConsumption{Time: first.Time.Add(time.Hour)}
+	second.Set("UsageTOUOffPeak", 0)
+	meter := torontohydro.Meter{MeterNumber: "1234", Account: "home", Tags: map[string]string{"building": "a"}}
+
+	err := sink.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(receiver.requests))
+	}
+	if got := receiver.headers.Get("Content-Encoding"); got != "snappy" {
+		t.Errorf("Content-Encoding = %q, want snappy", got)
+	}
+	if got := receiver.headers.Get("Authorization"); got != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("Authorization = %q, want basic auth", got)
+	}
+
+	labels := func(name string) []prompb.Label {
+		return []prompb.Label{
+			{Name: "__name__", Value: name},
+			{Name: "account", Value: "home"},
+			{Name: "building", Value: "a"},
+			{Name: "meter", Value: "1234"},
+			{Name: "period", Value: "off_peak"},
+			{Name: "plan", Value: "tou"},
+		}
+	}
+	want := []prompb.TimeSeries{
+		{
+			Labels: labels("toronto_hydro_usage_kwh"),
+			Samples: []prompb.Sample{
+				{Value: 0.5, Timestamp: first.Time.UnixMilli()},
+				{Value: 0, Timestamp: second.Time.UnixMilli()},
+			},
+		},
+		{
+			Labels: labels("toronto_hydro_cost_dollars"),
+			Samples: []prompb.Sample{
+				{Value: float64(float32(0.04)), Timestamp: first.Time.UnixMilli()},
+			},
+		},
+	}
+	got := receiver.requests[0].Timeseries
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("time series = %+v, want %+v", got, want)
+	}
+	// 2022-11-06 00:00 in Toronto is 04:00 UTC
+	if timestamp := got[0].Samples[0].Timestamp; timestamp != 1667707200000 {
+		t.Errorf("timestamp = %d, want milliseconds", timestamp)
+	}
+}
+
+func TestWriteRejected(t *testing.T) {
+	receiver := &receiver{status: http.StatusBadRequest}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sink := newTestSink(server.URL)
+	defer sink.Close()
+
+	consumption := &torontohydro.ElectricConsumption{Time: time.Date(2022, 11, 6, 0, 0, 0, 0, torontohydro.Location)}
+	consumption.Set("UsageTOUOffPeak", 0.5)
+	err := sink.Write(context.Background(), torontohydro.Meter{MeterNumber: "1234"}, []*torontohydro.ElectricConsumption{consumption})
+	if err == nil {
+		t.Error("rejected write returned no error")
+	}
+}
@@ -0,0 +1,60 @@
+package sink
+
+import (
+	"strconv"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+// tolerance below which values are considered equal, Toronto Hydro reports two decimals
+const tolerance = 0.0005
+
+// Revision is a stored consumption that Toronto Hydro replaced, e.g. an estimated read by an actual one.
+type Revision struct {
+	Old *torontohydro.ElectricConsumption
+	New *torontohydro.ElectricConsumption
+}
+
+// ChangedFields returns the old and new values of the fields that differ.
+func (r Revision) ChangedFields() ([]torontohydro.Field, []torontohydro.Field) {
+	var oldFields, newFields []torontohydro.Field
+	updated := r.New.Fields()
+	for i, old := range r.Old.Fields() {
+		if !equal(old.Value, updated[i].Value) {
+			oldFields = append(oldFields, old)
+			newFields = append(newFields, updated[i])
+		}
+	}
+	return oldFields, newFields
+}
+
+// Changes describes the fields that differ, e.g. "UsageLowTier 0.21 -> 0.25".
+func (r Revision) Changes() []string {
+	var changes []string
+	oldFields, newFields := r.ChangedFields()
+	for i, old := range oldFields {
+		changes = append(changes, old.Name+" "+format(old.Value)+" -> "+format(newFields[i].Value))
+	}
+	return changes
+}
+
+// equal compares the stored and the fetched value. A missing stored value equals a fetched zero,
+// as hours stored before zero values were kept have no zero fields. A value that is no longer reported
+// is not a revision, as sinks like InfluxDB keep the stored value when writing the hour without it.
+func equal(stored *float32, fetched *float32) bool {
+	if fetched == nil {
+		return true
+	}
+	var diff float32 = *fetched
+	if stored != nil {
+		diff -= *stored
+	}
+	return diff < tolerance && diff > -tolerance
+}
+
+func format(value *float32) string {
+	if value == nil {
+		return "empty"
+	}
+	return strconv.FormatFloat(float64(*value), 'f', -1, 32)
+}
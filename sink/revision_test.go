@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+func value(v float32) *float32 {
+	return &v
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  *float32
+		fetched *float32
+		equal   bool
+	}{
+		{"both empty", nil, nil, true},
+		{"same value", value(0.21), value(0.21), true},
+		{"within tolerance", value(0.21), value(0.2104), true},
+		{"changed value", value(0.21), value(0.25), false},
+		{"stored empty fetched zero", nil, value(0), true},
+		{"stored empty fetched value", nil, value(0.25), false},
+		{"stored value fetched empty", value(0.21), nil, true},
+		{"stored zero fetched empty", value(0), nil, true},
+		{"negative value", value(-0.5), value(-0.5), true},
+	}
+	for _, test := range tests {
+		if got := equal(test.stored, test.fetched); got != test.equal {
+			t.Errorf("%s: equal = %v, want %v", test.name, got, test.equal)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	stored := &torontohydro.ElectricConsumption{}
+	stored.Set("UsageLowTier", 0.21)
+	fetched := &torontohydro.ElectricConsumption{}
+	fetched.Set("UsageLowTier", 0.25)
+	// hours stored before zero values were kept have no zero fields
+	fetched.Set("UsageHighTier", 0)
+	fetched.Set("CostLowTier", 0.03)
+
+	changes := Revision{Old: stored, New: fetched}.Changes()
+	want := []string{"UsageLowTier 0.21 -> 0.25", "CostLowTier empty -> 0.03"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %q, want %q", changes, want)
+	}
+
+	fetched.Set("UsageLowTier", 0.21)
+	fetched.Set("CostLowTier", 0)
+	if changes := (Revision{Old: stored, New: fetched}).Changes(); len(changes) > 0 {
+		t.Errorf("changes = %q, want none", changes)
+	}
+}
@@ -0,0 +1,181 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/metrics"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+// Sink is a destination for exported consumptions, e.g. InfluxDB.
+type Sink interface {
+	// Name identifies the sink in log messages.
+	Name() string
+	// Existing returns the timestamps already stored for the meter between start and end.
+	Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error)
+	// Write stores the consumptions of the meter.
+	Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error
+	// Close releases all resources held by the sink.
+	Close()
+}
+
+// Reader is implemented by sinks that can return the stored consumptions, so revised hours can be detected.
+type Reader interface {
+	// Stored returns the consumptions stored for the meter between start and end.
+	Stored(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]*torontohydro.ElectricConsumption, error)
+}
+
+// RevisionWriter is implemented by sinks that keep the history of revised hours.
+type RevisionWriter interface {
+	// WriteRevisions records the revisions of the meter, after the revised consumptions have been written.
+	WriteRevisions(ctx context.Context, meter torontohydro.Meter, revisions []Revision) error
+}
+
+// ExportError holds the errors of the sinks an export failed for.
+type ExportError struct {
+	Errors map[string]error
+}
+
+func (e *ExportError) Error() string {
+	var names []string
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("export to %s failed", strings.Join(names, ", "))
+}
+
+// Export writes the consumptions, sorted by time, to all sinks, skipping those already stored in the respective sink.
+// If dedup is set, it is used instead to determine which consumptions have already been stored.
+// With corrections enabled, stored consumptions of sinks implementing Reader are compared with the fetched ones
+// and overwritten if Toronto Hydro revised them.
+// An *ExportError is returned if any sink failed, remaining sinks are skipped once the context is cancelled.
+func Export(ctx context.Context, sinks []Sink, dedup Sink, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption, corrections bool) error {
+
+	// start & end can be determined based on first and last consumption
+	startDateTime := consumptions[0].Time.Add(-1 * time.Hour)
+	endDateTime := consumptions[len(consumptions)-1].Time.Add(1 * time.Hour)
+
+	// query dedup sink once, before any sink gets written
+	var dedupRemaining []*torontohydro.ElectricConsumption
+	var dedupRevisions []Revision
+	if dedup != nil {
+		var err error
+		dedupRemaining, dedupRevisions, err = filter(ctx, dedup, meter, consumptions, startDateTime, endDateTime, corrections)
+		if err != nil {
+			log.Printf("Error checking existing metrics in %s [%s]!\n", dedup.Name(), err.Error())
+			return err
+		}
+	}
+
+	failed := map[string]error{}
+	for _, sink := range sinks {
+		if ctx.Err() != nil {
+			failed[sink.Name()] = ctx.Err()
+			continue
+		}
+
+		remaining, revisions := dedupRemaining, dedupRevisions
+		if dedup == nil {
+			var err error
+			remaining, revisions, err = filter(ctx, sink, meter, consumptions, startDateTime, endDateTime, corrections)
+			if err != nil {
+				log.Printf("Error checking existing metrics in %s [%s]!\n", sink.Name(), err.Error())
+				failed[sink.Name()] = err
+				continue
+			}
+		}
+
+		metrics.PointsSkipped(sink.Name(), len(consumptions)-len(remaining))
+		if len(remaining) == 0 {
+			log.Printf("No new metrics available, skip export to %s\n", sink.Name())
+			continue
+		}
+
+		err := sink.Write(ctx, meter, remaining)
+		if err != nil {
+			log.Printf("Error exporting metrics to %s [%s]!\n", sink.Name(), err.Error())
+			failed[sink.Name()] = err
+			continue
+		}
+		metrics.PointsWritten(sink.Name(), len(remaining))
+
+		if len(revisions) > 0 {
+			metrics.PointsRevised(sink.Name(), len(revisions))
+			if writer, ok := sink.(RevisionWriter); ok {
+				err = writer.WriteRevisions(ctx, meter, revisions)
+				if err != nil {
+					log.Printf("Error recording revisions in %s [%s]!\n", sink.Name(), err.Error())
+					failed[sink.Name()] = err
+				}
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ExportError{Errors: failed}
+	}
+	return nil
+}
+
+// filter returns the consumptions that are not stored in the sink yet.
+// With corrections enabled and a sink implementing Reader, revised consumptions are returned as well, together with their revisions.
+func filter(ctx context.Context, sink Sink, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption, start time.Time, end time.Time, corrections bool) ([]*torontohydro.ElectricConsumption, []Revision, error) {
+	var remaining []*torontohydro.ElectricConsumption
+
+	if reader, ok := sink.(Reader); ok && corrections {
+		stored, err := reader.Stored(ctx, meter, start, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		storedByTime := map[int64]*torontohydro.ElectricConsumption{}
+		for _, consumption := range stored {
+			storedByTime[consumption.Time.Unix()] = consumption
+		}
+
+		var revisions []Revision
+		for _, consumption := range consumptions {
+			old, ok := storedByTime[consumption.Time.Unix()]
+			if !ok {
+				remaining = append(remaining, consumption)
+				continue
+			}
+			revision := Revision{Old: old, New: consumption}
+			if changes := revision.Changes(); len(changes) > 0 {
+				log.Printf("Hour %s of meter %s was revised in %s: %s\n", consumption.Time.Format(time.RFC3339), meter.MeterNumber, sink.Name(), strings.Join(changes, ", "))
+				remaining = append(remaining, consumption)
+				revisions = append(revisions, revision)
+			}
+		}
+		return remaining, revisions, nil
+	}
+
+	existing, err := sink.Existing(ctx, meter, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// skip consumptions that have already been submitted, a timestamp may be returned more than once
+	stored := make(map[int64]struct{}, len(existing))
+	for _, timestamp := range existing {
+		stored[timestamp.Unix()] = struct{}{}
+	}
+	for _, consumption := range consumptions {
+		if _, ok := stored[consumption.Time.Unix()]; !ok {
+			remaining = append(remaining, consumption)
+		}
+	}
+	return remaining, nil, nil
+}
+
+// Close closes all sinks.
+func Close(sinks []Sink) {
+	for _, sink := range sinks {
+		sink.Close()
+	}
+}
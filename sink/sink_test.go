@@ -0,0 +1,205 @@
+package sink
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+// memorySink keeps the written timestamps in memory.
+type memorySink struct {
+	timestamps []time.Time
+	// repeat returns each timestamp as often, like a query returning one record per field
+	repeat int
+}
+
+func (s *memorySink) Name() string {
+	return "memory"
+}
+
+func (s *memorySink) Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	var existing []time.Time
+	for _, timestamp := range s.timestamps {
+		if timestamp.Before(start) || !timestamp.Before(end) {
+			continue
+		}
+		for i := 0; i < s.repeat; i++ {
+			existing = append(existing, timestamp)
+		}
+	}
+	return existing, nil
+}
+
+func (s *memorySink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+	for _, consumption := range consumptions {
+		s.timestamps = append(s.timestamps, consumption.Time)
+	}
+	return nil
+}
+
+func (s *memorySink) Close() {
+}
+
+// readerSink keeps the written consumptions in memory and, like InfluxDB, only overwrites the fields that are set.
+type readerSink struct {
+	memorySink
+	stored map[int64]*torontohydro.ElectricConsumption
+}
+
+func (s *readerSink) Stored(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]*torontohydro.ElectricConsumption, error) {
+	var stored []*torontohydro.ElectricConsumption
+	for _, consumption := range s.stored {
+		if consumption.Time.Before(start) || !consumption.Time.Before(end) {
+			continue
+		}
+		copied := *consumption
+		stored = append(stored, &copied)
+	}
+	return stored, nil
+}
+
+func (s *readerSink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+	for _, consumption := range consumptions {
+		stored, ok := s.stored[consumption.Time.Unix()]
+		if !ok {
+			stored = &torontohydro.ElectricConsumption{Time: consumption.Time}
+			s.stored[consumption.Time.Unix()] = stored
+		}
+		for _, field := range consumption.Fields() {
+			if field.Value != nil {
+				stored.Set(field.Name, *field.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// hour returns a consumption of the given hour with the given values, a negative value leaves the field empty.
+func hour(h int, usage float32, cost float32) *torontohydro.ElectricConsumption {
+	consumption := &torontohydro.ElectricConsumption{Time: time.Date(2022, 1, 1, h, 0, 0, 0, torontohydro.Location)}
+	if usage >= 0 {
+		consumption.Set("UsageTOUOffPeak", usage)
+	}
+	if cost >= 0 {
+		consumption.Set("CostTOUOffPeak", cost)
+	}
+	return consumption
+}
+
+func TestFilterRevisions(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	meter := torontohydro.Meter{MeterNumber: "1234"}
+	reader := &readerSink{stored: map[int64]*torontohydro.ElectricConsumption{}}
+	reader.Write(context.Background(), meter, []*torontohydro.ElectricConsumption{
+		hour(1, 0.5, 0.04),
+		hour(2, 0.5, 0.04),
+		hour(3, 0.5, 0.04),
+	})
+
+	fetched := []*torontohydro.ElectricConsumption{
+		// new hour
+		hour(0, 0.5, 0.04),
+		// revised hour
+		hour(1, 0.7, 0.06),
+		// unchanged hour
+		hour(2, 0.5, 0.04),
+		// the usage is no longer reported, the stored value is kept
+		hour(3, -1, 0.04),
+	}
+	start := fetched[0].Time.Add(-1 * time.Hour)
+	end := fetched[len(fetched)-1].Time.Add(1 * time.Hour)
+
+	remaining, revisions, err := filter(context.Background(), reader, meter, fetched, start, end, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remaining, fetched[:2]) {
+		t.Errorf("remaining = %d hours, want hours 0 and 1", len(remaining))
+	}
+	if len(revisions) != 1 || revisions[0].New != fetched[1] || *revisions[0].Old.UsageTOUOffPeak != 0.5 {
+		t.Errorf("revisions = %+v, want hour 1", revisions)
+	}
+
+	// once written, the same hours are no revision anymore
+	reader.Write(context.Background(), meter, remaining)
+	remaining, revisions, err = filter(context.Background(), reader, meter, fetched, start, end, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) > 0 || len(revisions) > 0 {
+		t.Errorf("second pass: %d hours remaining and %d revisions, want none", len(remaining), len(revisions))
+	}
+
+	// without corrections only new hours are returned
+	remaining, _, err = filter(context.Background(), &memorySink{timestamps: []time.Time{fetched[1].Time}, repeat: 1}, meter, fetched, start, end, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 3 {
+		t.Errorf("remaining = %d hours, want 3", len(remaining))
+	}
+}
+
+// oneYear returns the hourly consumptions of a year.
+func oneYear() []*torontohydro.ElectricConsumption {
+	var consumptions []*torontohydro.ElectricConsumption
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, torontohydro.Location)
+	for t := start; t.Before(start.AddDate(1, 0, 0)); t = t.Add(time.Hour) {
+		consumption := &torontohydro.ElectricConsumption{Time: t}
+		consumption.Set("UsageTOUOffPeak", 0.5)
+		consumption.Set("CostTOUOffPeak", 0.04)
+		consumptions = append(consumptions, consumption)
+	}
+	return consumptions
+}
+
+// BenchmarkBackfillOneYear exports a year in weekly chunks to an empty sink, like the backfill command.
+func BenchmarkBackfillOneYear(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	consumptions := oneYear()
+	meter := torontohydro.Meter{MeterNumber: "1234"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		memory := &memorySink{repeat: 1}
+		for start := 0; start < len(consumptions); start += 7 * 24 {
+			end := start + 7*24
+			if end > len(consumptions) {
+				end = len(consumptions)
+			}
+			err := Export(context.Background(), []Sink{memory}, nil, meter, consumptions[start:end], false)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkFilterOneYear filters a year that is already stored, with every timestamp returned once per field.
+func BenchmarkFilterOneYear(b *testing.B) {
+	consumptions := oneYear()
+	meter := torontohydro.Meter{MeterNumber: "1234"}
+	memory := &memorySink{repeat: 18}
+	memory.Write(context.Background(), meter, consumptions)
+	start := consumptions[0].Time.Add(-1 * time.Hour)
+	end := consumptions[len(consumptions)-1].Time.Add(1 * time.Hour)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		remaining, _, err := filter(context.Background(), memory, meter, consumptions, start, end, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(remaining) > 0 {
+			b.Fatalf("%d hours not filtered", len(remaining))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+
+	_ "modernc.org/sqlite"
+)
+
+type Sink struct {
+	db *sql.DB
+}
+
+func NewSink(config helpers.Config) *Sink {
+	db, err := sql.Open("sqlite", config.SQLite.Path)
+	if err != nil {
+		log.Fatalf("Error opening SQLite database [%s]!\n", err.Error())
+	}
+	// sqlite only supports a single writer
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(schema())
+	if err != nil {
+		log.Fatalf("Error creating SQLite schema [%s]!\n", err.Error())
+	}
+
+	// databases created before accounts were supported lack their columns
+	for _, column := range []string{"account", "tags"} {
+		var exists bool
+		err = db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info('meters') WHERE name = ?`, column).Scan(&exists)
+		if err == nil && !exists {
+			_, err = db.Exec(`ALTER TABLE meters ADD COLUMN ` + column + ` TEXT`)
+		}
+		if err != nil {
+			log.Fatalf("Error migrating SQLite schema [%s]!\n", err.Error())
+		}
+	}
+
+	return &Sink{
+		db: db,
+	}
+}
+
+func (s *Sink) Name() string {
+	return "sqlite"
+}
+
+func (s *Sink) Existing(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT r.time FROM readings r JOIN meters m ON m.id = r.meter_id
+		WHERE m.meter_number = ? AND r.time >= ? AND r.time < ?`, meter.MeterNumber, start.Unix(), end.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timestamps []time.Time
+	for rows.Next() {
+		var seconds int64
+		err = rows.Scan(&seconds)
+		if err != nil {
+			return nil, err
+		}
+		timestamps = append(timestamps, time.Unix(seconds, 0))
+	}
+	return timestamps, rows.Err()
+}
+
+// Stored returns the consumptions stored for the meter, used to detect revised hours.
+func (s *Sink) Stored(ctx context.Context, meter torontohydro.Meter, start time.Time, end time.Time) ([]*torontohydro.ElectricConsumption, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT r.time, `+strings.Join(columns(), ", ")+` FROM readings r JOIN meters m ON m.id = r.meter_id
+		WHERE m.meter_number = ? AND r.time >= ? AND r.time < ?`, meter.MeterNumber, start.Unix(), end.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := (&torontohydro.ElectricConsumption{}).Fields()
+	var consumptions []*torontohydro.ElectricConsumption
+	for rows.Next() {
+		var seconds int64
+		values := make([]*float64, len(fields))
+		dest := []interface{}{&seconds}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		consumption := &torontohydro.ElectricConsumption{Time: time.Unix(seconds, 0)}
+		for i, field := range fields {
+			if values[i] != nil {
+				consumption.Set(field.Name, float32(*values[i]))
+			}
+		}
+		consumptions = append(consumptions, consumption)
+	}
+	return consumptions, rows.Err()
+}
+
+func (s *Sink) Write(ctx context.Context, meter torontohydro.Meter, consumptions []*torontohydro.ElectricConsumption) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// upsert meter
+	tags, err := json.Marshal(meter.Tags)
+	if err != nil {
+		return err
+	}
+	var meterID int64
+	err = tx.QueryRowContext(ctx, `INSERT INTO meters (meter_number, service_point_id, start_date, end_date, account, tags) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (meter_number) DO UPDATE SET service_point_id = excluded.service_point_id, start_date = excluded.start_date, end_date = excluded.end_date,
+		account = excluded.account, tags = excluded.tags
+		RETURNING id`, meter.MeterNumber, meter.Id, meter.StartDate, meter.EndDate, meter.Account, string(tags)).Scan(&meterID)
+	if err != nil {
+		return err
+	}
+
+	// upsert readings
+	columns := columns()
+	updates := make([]string, len(columns))
+	for i, column := range columns {
+		updates[i] = column + " = excluded." + column
+	}
+	statement, err := tx.PrepareContext(ctx, `INSERT INTO readings (meter_id, time, `+strings.Join(columns, ", ")+`)
+		VALUES (?, ?`+strings.Repeat(", ?", len(columns))+`)
+		ON CONFLICT (meter_id, time) DO UPDATE SET `+strings.Join(updates, ", "))
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+
+	stored := 0
+	for _, consumption := range consumptions {
+		// hours without any value are not stored, so they are fetched again once published
+		if !consumption.HasData() {
+			continue
+		}
+		args := []interface{}{meterID, consumption.Time.Unix()}
+		for _, field := range consumption.Fields() {
+			args = append(args, field.Value)
+		}
+		_, err = statement.ExecContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+		stored++
+	}
+
+	log.Printf("Stored %d hours of meter %s in SQLite\n", stored, meter.MeterNumber)
+	return tx.Commit()
+}
+
+func (s *Sink) Close() {
+	s.db.Close()
+}
+
+// columns returns the reading columns, e.g. usage_tou_on_peak, in the order of ElectricConsumption.Fields.
+func columns() []string {
+	var columns []string
+	for _, field := range (&torontohydro.ElectricConsumption{}).Fields() {
+		columns = append(columns, field.Key())
+	}
+	return columns
+}
+
+func schema() string {
+	return `CREATE TABLE IF NOT EXISTS meters (
+		id INTEGER PRIMARY KEY,
+		meter_number TEXT NOT NULL UNIQUE,
+		service_point_id TEXT,
+		start_date TEXT,
+		end_date TEXT,
+		account TEXT,
+		tags TEXT
+	);
+	CREATE TABLE IF NOT EXISTS readings (
+		meter_id INTEGER NOT NULL REFERENCES meters (id),
+		time INTEGER NOT NULL,
+		` + strings.Join(columns(), " REAL,\n\t\t") + ` REAL,
+		PRIMARY KEY (meter_id, time)
+	);`
+}
@@ -0,0 +1,162 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/torontohydro"
+)
+
+var meter = torontohydro.Meter{MeterNumber: "1234", Account: "home", Tags: map[string]string{"building": "a"}}
+
+func newTestSink(t *testing.T, path string) *Sink {
+	var config helpers.Config
+	config.SQLite.Path = path
+	sink := NewSink(config)
+	t.Cleanup(sink.Close)
+	return sink
+}
+
+// hour returns a consumption of the given hour with the given values, a negative value leaves the field empty.
+func hour(h int, usage float32, cost float32) *torontohydro.ElectricConsumption {
+	consumption := &torontohydro.ElectricConsumption{Time: time.Date(2022, 1, 1, h, 0, 0, 0, torontohydro.Location)}
+	if usage >= 0 {
+		consumption.Set("UsageTOUOffPeak", usage)
+	}
+	if cost >= 0 {
+		consumption.Set("CostTOUOffPeak", cost)
+	}
+	return consumption
+}
+
+func write(t *testing.T, sink *Sink, consumptions ...*torontohydro.ElectricConsumption) {
+	t.Helper()
+	if err := sink.Write(context.Background(), meter, consumptions); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stored(t *testing.T, sink *Sink, start time.Time, end time.Time) map[int]*torontohydro.ElectricConsumption {
+	t.Helper()
+	consumptions, err := sink.Stored(context.Background(), meter, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byHour := map[int]*torontohydro.ElectricConsumption{}
+	for _, consumption := range consumptions {
+		byHour[consumption.Time.In(torontohydro.Location).Hour()] = consumption
+	}
+	return byHour
+}
+
+func TestWriteOverwrites(t *testing.T) {
+	sink := newTestSink(t, filepath.Join(t.TempDir(), "test.db"))
+	write(t, sink, hour(0, 0.5, 0.04))
+	write(t, sink, hour(0, 0.7, 0.06))
+
+	byHour := stored(t, sink, hour(0, -1, -1).Time, hour(1, -1, -1).Time)
+	if len(byHour) != 1 {
+		t.Fatalf("stored %d hours, want 1", len(byHour))
+	}
+	if usage := byHour[0].UsageTOUOffPeak; usage == nil || *usage != 0.7 {
+		t.Errorf("usage = %v, want 0.7", usage)
+	}
+	if cost := byHour[0].CostTOUOffPeak; cost == nil || *cost != 0.06 {
+		t.Errorf("cost = %v, want 0.06", cost)
+	}
+}
+
+func TestRange(t *testing.T) {
+	sink := newTestSink(t, filepath.Join(t.TempDir(), "test.db"))
+	write(t, sink, hour(0, 0.5, 0.04), hour(1, 0.5, 0.04), hour(2, 0.5, 0.04))
+	start, end := hour(1, -1, -1).Time, hour(2, -1, -1).Time
+
+	existing, err := sink.Existing(context.Background(), meter, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(existing) != 1 || !existing[0].Equal(start) {
+		t.Errorf("existing = %v, want only hour 1", existing)
+	}
+
+	byHour := stored(t, sink, start, end)
+	if _, ok := byHour[1]; len(byHour) != 1 || !ok {
+		t.Errorf("stored %d hours, want only hour 1", len(byHour))
+	}
+
+	existing, err = sink.Existing(context.Background(), torontohydro.Meter{MeterNumber: "5678"}, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(existing) > 0 {
+		t.Errorf("existing = %v for another meter, want none", existing)
+	}
+}
+
+func TestNullAndZero(t *testing.T) {
+	sink := newTestSink(t, filepath.Join(t.TempDir(), "test.db"))
+	write(t, sink, hour(0, 0, -1))
+
+	byHour := stored(t, sink, hour(0, -1, -1).Time, hour(1, -1, -1).Time)
+	if usage := byHour[0].UsageTOUOffPeak; usage == nil || *usage != 0 {
+		t.Errorf("usage = %v, want 0", usage)
+	}
+	if cost := byHour[0].CostTOUOffPeak; cost != nil {
+		t.Errorf("cost = %v, want NULL", *cost)
+	}
+}
+
+func TestSkipHoursWithoutData(t *testing.T) {
+	sink := newTestSink(t, filepath.Join(t.TempDir(), "test.db"))
+	write(t, sink, hour(0, 0.5, 0.04), hour(1, -1, -1))
+
+	existing, err := sink.Existing(context.Background(), meter, hour(0, -1, -1).Time, hour(2, -1, -1).Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(existing) != 1 || !existing[0].Equal(hour(0, -1, -1).Time) {
+		t.Errorf("existing = %v, want only hour 0", existing)
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// database created before accounts were supported
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE meters (
+		id INTEGER PRIMARY KEY,
+		meter_number TEXT NOT NULL UNIQUE,
+		service_point_id TEXT,
+		start_date TEXT,
+		end_date TEXT
+	);
+	INSERT INTO meters (meter_number) VALUES ('1234');`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := newTestSink(t, path)
+	write(t, sink, hour(0, 0.5, 0.04))
+
+	var account, tags string
+	err = sink.db.QueryRow(`SELECT account, tags FROM meters WHERE meter_number = '1234'`).Scan(&account, &tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account != "home" || tags != `{"building":"a"}` {
+		t.Errorf("account = %q, tags = %q, want home and the building tag", account, tags)
+	}
+
+	// opening a migrated database again doesn't alter it
+	sink.Close()
+	newTestSink(t, path)
+}
@@ -0,0 +1,215 @@
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dtrumpfheller/toronto-hydro-exporter/metrics"
+	"github.com/dtrumpfheller/toronto-hydro-exporter/sink"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Status is the state of the exporter as reported by the HTTP endpoints, updated by the main loop.
+type Status struct {
+	mutex    sync.RWMutex
+	ready    bool
+	stopping bool
+	server   *http.Server
+
+	Started       time.Time               `json:"started"`
+	Healthy       bool                    `json:"healthy"`
+	LastRun       *time.Time              `json:"lastRun,omitempty"`
+	NextRun       *time.Time              `json:"nextRun,omitempty"`
+	LastError     string                  `json:"lastError,omitempty"`
+	LastErrorTime *time.Time              `json:"lastErrorTime,omitempty"`
+	Meters        map[string]*MeterStatus `json:"meters"`
+	Sinks         map[string]*SinkStatus  `json:"sinks"`
+}
+
+type MeterStatus struct {
+	Account       string     `json:"account,omitempty"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastTimestamp *time.Time `json:"lastTimestamp,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+type SinkStatus struct {
+	Healthy       bool       `json:"healthy"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// New creates the status of the given sinks, all of them are considered healthy until an export fails.
+func New(sinks []sink.Sink) *Status {
+	s := &Status{
+		Started: time.Now(),
+		Healthy: true,
+		Meters:  map[string]*MeterStatus{},
+		Sinks:   map[string]*SinkStatus{},
+	}
+	for _, sink := range sinks {
+		s.Sinks[sink.Name()] = &SinkStatus{Healthy: true}
+	}
+	return s
+}
+
+// Serve starts serving /healthz, /readyz, /status and the metrics about the exporter on the address.
+func (s *Status) Serve(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/status", s.status)
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	s.server = &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+		log.Printf("Serving status on %s/status\n", address)
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error serving status [%s]!\n", err.Error())
+		}
+	}()
+}
+
+// Close stops serving the endpoints.
+func (s *Status) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// Ready marks the startup as finished, failed exports are reported by /status instead of readiness.
+func (s *Status) Ready() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ready = true
+}
+
+// RunFinished records the end of an export cycle.
+func (s *Status) RunFinished(at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.LastRun = &at
+}
+
+// SetNextRun records when the next export cycle is scheduled.
+func (s *Status) SetNextRun(next time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.NextRun = &next
+}
+
+// Stopping marks the exporter as shutting down, it is no longer ready.
+func (s *Status) Stopping() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopping = true
+}
+
+// Error records an error that is not related to a single meter, e.g. a failed login.
+func (s *Status) Error(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	s.LastError = err.Error()
+	s.LastErrorTime = &now
+}
+
+// MeterExported records a successful export of the meter up to the given hour.
+func (s *Status) MeterExported(meter string, account string, lastTimestamp time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	status := s.meter(meter, account)
+	status.LastSuccess = &now
+	if status.LastTimestamp == nil || lastTimestamp.After(*status.LastTimestamp) {
+		status.LastTimestamp = &lastTimestamp
+	}
+}
+
+// MeterFailed records an error of the meter.
+func (s *Status) MeterFailed(meter string, account string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	status := s.meter(meter, account)
+	status.LastError = err.Error()
+	status.LastErrorTime = &now
+	s.LastError = err.Error()
+	s.LastErrorTime = &now
+}
+
+func (s *Status) meter(meter string, account string) *MeterStatus {
+	status, ok := s.Meters[meter]
+	if !ok {
+		status = &MeterStatus{}
+		s.Meters[meter] = status
+	}
+	status.Account = account
+	return status
+}
+
+// Exported records the result of sink.Export for each sink, the exporter is healthy if all sinks are.
+func (s *Status) Exported(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+
+	var exportErr *sink.ExportError
+	for name, status := range s.Sinks {
+		var sinkErr error
+		if errors.As(err, &exportErr) {
+			sinkErr = exportErr.Errors[name]
+		} else {
+			// export failed before any sink was written
+			sinkErr = err
+		}
+
+		if sinkErr == nil {
+			status.Healthy = true
+			status.LastSuccess = &now
+		} else {
+			status.Healthy = false
+			status.LastError = sinkErr.Error()
+			status.LastErrorTime = &now
+		}
+	}
+
+	s.Healthy = true
+	for _, status := range s.Sinks {
+		s.Healthy = s.Healthy && status.Healthy
+	}
+}
+
+func (s *Status) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Status) readyz(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	ready := s.ready && !s.stopping
+	s.mutex.RUnlock()
+	if !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Status) status(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(s)
+}
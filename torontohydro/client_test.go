@@ -0,0 +1,246 @@
+package torontohydro
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of the server that logs nothing and retries quickly.
+func newTestClient(server *httptest.Server, password string) *Client {
+	client := New("user", password)
+	client.BaseURL = server.URL
+	client.Logger = log.New(io.Discard, "", 0)
+	client.Backoff = time.Millisecond
+	return client
+}
+
+// sessionServer wraps the mock portal with sessions that can be expired.
+type sessionServer struct {
+	mutex   sync.Mutex
+	current int
+	logins  int32
+	// reject rejects logins, e.g. as the password was changed
+	reject bool
+}
+
+func (s *sessionServer) handler() http.Handler {
+	mock := MockHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/log-in" && r.Method == "POST" && r.FormValue("_th_module_authentication_ThModuleAuthenticationPortlet_password") != "invalid" {
+			atomic.AddInt32(&s.logins, 1)
+			s.mutex.Lock()
+			if s.reject {
+				s.mutex.Unlock()
+				loginPage(w, r)
+				return
+			}
+			s.current++
+			session := strconv.Itoa(s.current)
+			s.mutex.Unlock()
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: session, Path: "/"})
+			w.Write([]byte("Logged in!"))
+			return
+		}
+		if r.URL.Path == "/my-account/my-usage" {
+			cookie, err := r.Cookie("JSESSIONID")
+			s.mutex.Lock()
+			valid := err == nil && cookie.Value == strconv.Itoa(s.current)
+			s.mutex.Unlock()
+			if !valid {
+				loginPage(w, r)
+				return
+			}
+		}
+		mock.ServeHTTP(w, r)
+	})
+}
+
+// expire invalidates the current session, the next login creates a valid one.
+func (s *sessionServer) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.current++
+}
+
+func TestLogin(t *testing.T) {
+	server := httptest.NewServer(MockHandler())
+	defer server.Close()
+	client := newTestClient(server, "secret")
+
+	err := client.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meters, err := client.GetMeters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meters) != 1 || meters[0].MeterNumber != "1234" {
+		t.Errorf("meters = %+v", meters)
+	}
+	consumptions, err := client.GetData(context.Background(), meters[0], time.Date(2023, 6, 1, 0, 0, 0, 0, Location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consumptions) != 24 {
+		t.Errorf("got %d hours, want 24", len(consumptions))
+	}
+}
+
+func TestLoginFailed(t *testing.T) {
+	server := httptest.NewServer(MockHandler())
+	defer server.Close()
+	client := newTestClient(server, "invalid")
+
+	err := client.Login(context.Background())
+	if !errors.Is(err, ErrAuth) {
+		t.Errorf("error = %v, want ErrAuth", err)
+	}
+	_, err = client.GetMeters(context.Background())
+	if err == nil {
+		t.Error("got meters without session")
+	}
+}
+
+func TestReloginOnExpiredSession(t *testing.T) {
+	portal := &sessionServer{}
+	server := httptest.NewServer(portal.handler())
+	defer server.Close()
+	client := newTestClient(server, "secret")
+
+	err := client.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portal.expire()
+	meters, err := client.GetMeters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meters) != 1 {
+		t.Errorf("got %d meters, want 1", len(meters))
+	}
+	if logins := atomic.LoadInt32(&portal.logins); logins != 2 {
+		t.Errorf("logged in %d times, want 2", logins)
+	}
+}
+
+func TestReloginOnlyOnce(t *testing.T) {
+	// session expires right after each login
+	var logins int32
+	mock := MockHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/log-in" && r.Method == "POST" {
+			atomic.AddInt32(&logins, 1)
+		}
+		if r.URL.Path == "/my-account/my-usage" {
+			loginPage(w, r)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := newTestClient(server, "secret")
+
+	err := client.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetMeters(context.Background())
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("error = %v, want ErrSessionExpired", err)
+	}
+	if logins := atomic.LoadInt32(&logins); logins != 2 {
+		t.Errorf("logged in %d times, want 2", logins)
+	}
+}
+
+func TestConcurrentRelogin(t *testing.T) {
+	portal := &sessionServer{}
+	server := httptest.NewServer(portal.handler())
+	defer server.Close()
+	client := newTestClient(server, "secret")
+
+	err := client.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meters, err := client.GetMeters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portal.expire()
+
+	// all workers notice the expired session, only one of them logs in again
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.GetData(context.Background(), meters[0], time.Date(2023, 6, i+1, 0, 0, 0, 0, Location))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("worker %d failed [%s]", i, err.Error())
+		}
+	}
+	if logins := atomic.LoadInt32(&portal.logins); logins != 2 {
+		t.Errorf("logged in %d times, want 2", logins)
+	}
+}
+
+func TestReloginRejected(t *testing.T) {
+	portal := &sessionServer{}
+	server := httptest.NewServer(portal.handler())
+	defer server.Close()
+	client := newTestClient(server, "secret")
+
+	err := client.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meters, err := client.GetMeters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portal.mutex.Lock()
+	portal.reject = true
+	portal.mutex.Unlock()
+	portal.expire()
+
+	// concurrent and later callers get the error of the rejected re-login
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.GetData(context.Background(), meters[0], time.Date(2023, 6, i+1, 0, 0, 0, 0, Location))
+		}(i)
+	}
+	wg.Wait()
+	_, err = client.GetMeters(context.Background())
+	errs = append(errs, err)
+
+	for i, err := range errs {
+		if !errors.Is(err, ErrAuth) {
+			t.Errorf("call %d: error = %v, want ErrAuth", i, err)
+		}
+	}
+	if logins := atomic.LoadInt32(&portal.logins); logins != 2 {
+		t.Errorf("logged in %d times, want 2", logins)
+	}
+}
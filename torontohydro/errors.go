@@ -0,0 +1,100 @@
+package torontohydro
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrAuth           = errors.New("authentication failed")
+	ErrSessionExpired = errors.New("session expired")
+	ErrRateLimited    = errors.New("rate limited")
+	ErrServer         = errors.New("server error")
+	ErrNetwork        = errors.New("network error")
+	ErrParse          = errors.New("parse error")
+	ErrNotAvailable   = errors.New("data not yet available")
+)
+
+const maxBackoff = 30 * time.Second
+
+// IsTransient tells if the error might disappear when retrying.
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServer) || errors.Is(err, ErrNetwork)
+}
+
+// checkStatus classifies unsuccessful responses.
+func checkStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: status code [%d]", ErrAuth, resp.StatusCode)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: status code [%d]", ErrRateLimited, resp.StatusCode)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: status code [%d]", ErrServer, resp.StatusCode)
+	default:
+		return fmt.Errorf("unexpected status code [%d]", resp.StatusCode)
+	}
+}
+
+// backoff returns the exponential backoff with full jitter before the given retry.
+func (c *Client) backoff(retry int) time.Duration {
+	limit := c.Backoff << (retry - 1)
+	if limit > maxBackoff || limit <= 0 {
+		limit = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// do sends the request once the rate limit allows it, retrying transient failures.
+// Only successful responses are returned, waiting stops once the context of the request is cancelled.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			select {
+			case <-time.After(c.backoff(retry)):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			// body was consumed by previous attempt
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		err := c.Limiter.Wait(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		c.sessionMutex.RLock()
+		httpClient := c.httpClient
+		c.sessionMutex.RUnlock()
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			// cancelled requests are not retried
+			if req.Context().Err() != nil {
+				return nil, req.Context().Err()
+			}
+			err = fmt.Errorf("%w: %s", ErrNetwork, err.Error())
+		} else {
+			err = checkStatus(resp)
+			if err == nil {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+
+		if !IsTransient(err) || retry >= c.Retries {
+			return nil, err
+		}
+		c.Logger.Printf("Calling Toronto Hydro failed [%s], retrying...\n", err.Error())
+	}
+}
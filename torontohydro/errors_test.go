@@ -0,0 +1,134 @@
+package torontohydro
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		code      int
+		err       error
+		transient bool
+	}{
+		{http.StatusOK, nil, false},
+		{http.StatusUnauthorized, ErrAuth, false},
+		{http.StatusForbidden, ErrAuth, false},
+		{http.StatusTooManyRequests, ErrRateLimited, true},
+		{http.StatusInternalServerError, ErrServer, true},
+		{http.StatusServiceUnavailable, ErrServer, true},
+		{http.StatusNotFound, nil, false},
+	}
+	for _, test := range tests {
+		err := checkStatus(&http.Response{StatusCode: test.code})
+		if test.code == http.StatusOK {
+			if err != nil {
+				t.Errorf("%d: error = %v, want none", test.code, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%d: no error", test.code)
+			continue
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%d: error = %v, want %v", test.code, err, test.err)
+		}
+		if IsTransient(err) != test.transient {
+			t.Errorf("%d: transient = %v, want %v", test.code, IsTransient(err), test.transient)
+		}
+	}
+}
+
+// statusServer answers with the given status codes in turn, the last one repeatedly.
+func statusServer(codes ...int) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index := int(atomic.AddInt32(&requests, 1)) - 1
+		if index >= len(codes) {
+			index = len(codes) - 1
+		}
+		w.WriteHeader(codes[index])
+	}))
+	return server, &requests
+}
+
+func TestDoRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int
+		err      error
+		requests int32
+	}{
+		{"success", []int{200}, nil, 1},
+		{"transient failures", []int{503, 429, 200}, nil, 3},
+		{"retries exhausted", []int{500}, ErrServer, 4},
+		{"auth failure not retried", []int{401}, ErrAuth, 1},
+		{"client error not retried", []int{404}, nil, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := statusServer(test.codes...)
+			defer server.Close()
+			client := newTestClient(server, "secret")
+
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			resp, err := client.do(req)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			last := test.codes[len(test.codes)-1]
+			if last == http.StatusOK && err != nil {
+				t.Errorf("error = %v, want none", err)
+			}
+			if last != http.StatusOK && err == nil {
+				t.Error("no error")
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("error = %v, want %v", err, test.err)
+			}
+			if got := atomic.LoadInt32(requests); got != test.requests {
+				t.Errorf("sent %d requests, want %d", got, test.requests)
+			}
+		})
+	}
+}
+
+func TestDoNetworkError(t *testing.T) {
+	server, _ := statusServer(200)
+	client := newTestClient(server, "secret")
+	client.Retries = 1
+	server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := client.do(req)
+	if !errors.Is(err, ErrNetwork) {
+		t.Errorf("error = %v, want ErrNetwork", err)
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	// cancelled while the first request is answered, so no retry is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := newTestClient(server, "secret")
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	_, err := client.do(req)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("sent %d requests, want 1", got)
+	}
+}
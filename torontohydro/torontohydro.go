@@ -3,216 +3,429 @@ package torontohydro
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata" // Location must not depend on the timezone database of the system
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/dtrumpfheller/toronto-hydro-exporter/helpers"
 	"github.com/gocarina/gocsv"
+	"golang.org/x/time/rate"
 )
 
 type DateTime struct {
 	time.Time
 }
 
+// ElectricConsumption is a row of the hourly usage, values of empty cells are nil.
 type ElectricConsumption struct {
 	TimeTemp          string    `csv:"Time"`
-	UsageTOUOffPeak   float32   `csv:"Usage TOU off-peak (kWh)"`
-	UsageTOUMidPeak   float32   `csv:"Usage TOU mid-peak (kWh)"`
-	UsageTOUOnPeak    float32   `csv:"Usage TOU on-peak (kWh)"`
-	UsageLowTier      float32   `csv:"Usage tier 1 (kWh)"`
-	UsageHighTier     float32   `csv:"Usage tier 2 (kWh)"`
-	UsageULOOvernight float32   `csv:"Usage ULO overnight (kWh)"`
-	UsageULOOffPeal   float32   `csv:"Usage ULO off-peak (kWh)"`
-	UsageULOMidPeak   float32   `csv:"Usage ULO mid-peak (kWh)"`
-	UsageULOOnPeak    float32   `csv:"Usage ULO on-peak (kWh)"`
-	CostTOUOffPeak    float32   `csv:"Cost TOU off-peak ($)"`
-	CostTOUMidPeak    float32   `csv:"Cost TOU mid-peak ($)"`
-	CostTOUOnPeak     float32   `csv:"Cost TOU on-peak ($)"`
-	CostLowTier       float32   `csv:"Cost tier 1 ($)"`
-	CostHighTier      float32   `csv:"Cost tier 2 ($)"`
-	CostULOOvernight  float32   `csv:"Cost ULO overnight ($)"`
-	CostULOOffPeal    float32   `csv:"Cost ULO off-peak ($)"`
-	CostULOMidPeak    float32   `csv:"Cost ULO mid-peak ($)"`
-	CostULOOnPeak     float32   `csv:"Cost ULO on-peak ($)"`
+	UsageTOUOffPeak   *float32  `csv:"Usage TOU off-peak (kWh),omitempty"`
+	UsageTOUMidPeak   *float32  `csv:"Usage TOU mid-peak (kWh),omitempty"`
+	UsageTOUOnPeak    *float32  `csv:"Usage TOU on-peak (kWh),omitempty"`
+	UsageLowTier      *float32  `csv:"Usage tier 1 (kWh),omitempty"`
+	UsageHighTier     *float32  `csv:"Usage tier 2 (kWh),omitempty"`
+	UsageULOOvernight *float32  `csv:"Usage ULO overnight (kWh),omitempty"`
+	UsageULOOffPeak   *float32  `csv:"Usage ULO off-peak (kWh),omitempty"`
+	UsageULOMidPeak   *float32  `csv:"Usage ULO mid-peak (kWh),omitempty"`
+	UsageULOOnPeak    *float32  `csv:"Usage ULO on-peak (kWh),omitempty"`
+	CostTOUOffPeak    *float32  `csv:"Cost TOU off-peak ($),omitempty"`
+	CostTOUMidPeak    *float32  `csv:"Cost TOU mid-peak ($),omitempty"`
+	CostTOUOnPeak     *float32  `csv:"Cost TOU on-peak ($),omitempty"`
+	CostLowTier       *float32  `csv:"Cost tier 1 ($),omitempty"`
+	CostHighTier      *float32  `csv:"Cost tier 2 ($),omitempty"`
+	CostULOOvernight  *float32  `csv:"Cost ULO overnight ($),omitempty"`
+	CostULOOffPeak    *float32  `csv:"Cost ULO off-peak ($),omitempty"`
+	CostULOMidPeak    *float32  `csv:"Cost ULO mid-peak ($),omitempty"`
+	CostULOOnPeak     *float32  `csv:"Cost ULO on-peak ($),omitempty"`
 	Time              time.Time `csv:"-"`
 }
 
+// Field is a single value of a consumption together with its rate plan and period.
+type Field struct {
+	Name   string
+	Kind   string
+	Plan   string
+	Period string
+	// Value is nil if the cell was empty
+	Value *float32
+}
+
+// Fields returns all values of the consumption.
+func (c *ElectricConsumption) Fields() []Field {
+	return []Field{
+		{"UsageHighTier", "usage", "tiered", "tier2", c.UsageHighTier},
+		{"UsageLowTier", "usage", "tiered", "tier1", c.UsageLowTier},
+		{"UsageTOUOnPeak", "usage", "tou", "on_peak", c.UsageTOUOnPeak},
+		{"UsageTOUMidPeak", "usage", "tou", "mid_peak", c.UsageTOUMidPeak},
+		{"UsageTOUOffPeak", "usage", "tou", "off_peak", c.UsageTOUOffPeak},
+		{"UsageULOOvernight", "usage", "ulo", "overnight", c.UsageULOOvernight},
+		{"UsageULOOffPeak", "usage", "ulo", "off_peak", c.UsageULOOffPeak},
+		{"UsageULOMidPeak", "usage", "ulo", "mid_peak", c.UsageULOMidPeak},
+		{"UsageULOOnPeak", "usage", "ulo", "on_peak", c.UsageULOOnPeak},
+		{"CostHighTier", "cost", "tiered", "tier2", c.CostHighTier},
+		{"CostLowTier", "cost", "tiered", "tier1", c.CostLowTier},
+		{"CostTOUOnPeak", "cost", "tou", "on_peak", c.CostTOUOnPeak},
+		{"CostTOUMidPeak", "cost", "tou", "mid_peak", c.CostTOUMidPeak},
+		{"CostTOUOffPeak", "cost", "tou", "off_peak", c.CostTOUOffPeak},
+		{"CostULOOvernight", "cost", "ulo", "overnight", c.CostULOOvernight},
+		{"CostULOOffPeak", "cost", "ulo", "off_peak", c.CostULOOffPeak},
+		{"CostULOMidPeak", "cost", "ulo", "mid_peak", c.CostULOMidPeak},
+		{"CostULOOnPeak", "cost", "ulo", "on_peak", c.CostULOOnPeak},
+	}
+}
+
+// HasData tells if any value of the consumption is set, zero and negative values count as data.
+func (c *ElectricConsumption) HasData() bool {
+	for _, field := range c.Fields() {
+		if field.Value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Set sets the value of the field with the given name, returns false if there is no such field.
+func (c *ElectricConsumption) Set(name string, value float32) bool {
+	field := reflect.ValueOf(c).Elem().FieldByName(name)
+	if !field.IsValid() || field.Type() != reflect.TypeOf(&value) {
+		return false
+	}
+	field.Set(reflect.ValueOf(&value))
+	return true
+}
+
+// Key returns a snake case identifier of the field, e.g. usage_tou_on_peak.
+func (f Field) Key() string {
+	return f.Kind + "_" + f.Plan + "_" + f.Period
+}
+
 type Meter struct {
 	MeterNumber string `json:"meterNum"`
 	Id          string `json:"id"`
 	StartDate   string `json:"startDate"`
 	EndDate     string `json:"endDate"`
+	// Account and Tags of the client the meter belongs to
+	Account string            `json:"-"`
+	Tags    map[string]string `json:"-"`
+}
+
+// Labels returns the account and tags of the meter, e.g. to be added as tags to exported points.
+func (m Meter) Labels() map[string]string {
+	labels := map[string]string{}
+	for key, value := range m.Tags {
+		labels[key] = value
+	}
+	if len(m.Account) > 0 {
+		labels["account"] = m.Account
+	}
+	return labels
+}
+
+// Location is the timezone of Toronto Hydro, dates and hours of the portal are local to it.
+var Location = mustLoadLocation("America/Toronto")
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+const (
+	DefaultBaseURL = "https://www.torontohydro.com"
+
+	loginFormID = "_th_module_authentication_ThModuleAuthenticationPortlet_authentication"
+	usagePath   = "/my-account/my-usage?p_p_id=thmoduletou&p_p_lifecycle=2&p_p_state=normal&p_p_mode=view&p_p_cacheability=cacheLevelPage&p_p_resource_id="
+)
+
+// Client is a session with the Toronto Hydro portal of a single account.
+type Client struct {
+	// BaseURL of the portal, can be changed to point to a mock
+	BaseURL  string
+	Username string
+	Password string
+	// Name and Tags identify the account on its meters, both are optional
+	Name string
+	Tags map[string]string
+	// Logger receives all log messages of the client
+	Logger *log.Logger
+	// Limiter limits the requests sent, can be shared between clients
+	Limiter *rate.Limiter
+	// Retries of transient failures and the backoff before the first retry
+	Retries int
+	Backoff time.Duration
+	// Transport sends the requests, e.g. to instrument them, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+
+	// guards httpClient and session, the latter counts logins to avoid concurrent re-logins
+	sessionMutex sync.RWMutex
+	session      int
+	reloginMutex sync.Mutex
+	httpClient   *http.Client
+	// error of the failed re-login of the session, returned to all callers instead of logging in again
+	reloginSession int
+	reloginErr     error
 }
 
-var client http.Client
+// New creates a client for the account, nothing is sent before calling Login.
+func New(username string, password string) *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		Username:   username,
+		Password:   password,
+		Logger:     log.Default(),
+		Limiter:    rate.NewLimiter(rate.Inf, 1),
+		Retries:    3,
+		Backoff:    time.Second,
+		httpClient: &http.Client{},
+	}
+}
 
-func Login(config helpers.Config) error {
+// NewRateLimiter creates a limiter for the requests sent to Toronto Hydro, zero or less disables the limit.
+func NewRateLimiter(requestsPerSecond float64) *rate.Limiter {
+	if requestsPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Limit(requestsPerSecond), 1)
+}
+
+func (c *Client) Login(ctx context.Context) error {
 
-	log.Println("Logging into Toronto Hydro... ")
+	c.Logger.Println("Logging into Toronto Hydro... ")
 
 	// create cookie jar
 	jar, err := cookiejar.New(nil)
 	if err != nil {
-		log.Printf("Got error while creating cookie jar [%s]!", err.Error())
+		c.Logger.Printf("Got error while creating cookie jar [%s]!", err.Error())
 		return err
 	}
-	client = http.Client{
-		Jar: jar,
+	c.sessionMutex.Lock()
+	c.httpClient = &http.Client{
+		Jar:       jar,
+		Transport: c.Transport,
 	}
+	c.sessionMutex.Unlock()
 
 	// get login page
-	url := "https://www.torontohydro.com/log-in"
-	if config.TorontoHydro.Mock {
-		url = "http://localhost:9999/log-in"
-	}
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/log-in", nil)
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
+		c.Logger.Printf("Got error %s", err.Error())
 		return err
 	}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		log.Printf("Error getting Toronto Hydro login page [%s]!\n", err.Error())
+		c.Logger.Printf("Error getting Toronto Hydro login page [%s]!\n", err.Error())
 		return err
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("Getting Toronto Hydro login page failed with status code [%d]!\n", resp.StatusCode)
-		return errors.New("Error")
-	}
 
 	// extract login portlet url
 	defer resp.Body.Close()
 	loginPageBody, err := goquery.NewDocumentFromReader(resp.Body)
 	if err != nil {
-		log.Printf("Error processing Toronto Hydro login page [%s]!\n", err.Error())
-		return err
-	}
-	loginUrl := loginPageBody.Find("#_th_module_authentication_ThModuleAuthenticationPortlet_authentication").AttrOr("action", "")
-	if config.TorontoHydro.Mock {
-		loginUrl = "http://localhost:9999/log-in"
+		c.Logger.Printf("Error processing Toronto Hydro login page [%s]!\n", err.Error())
+		return fmt.Errorf("%w: %s", ErrParse, err.Error())
 	}
+	loginUrl := loginPageBody.Find("#"+loginFormID).AttrOr("action", "")
 
 	// logging in
-	body := "_th_module_authentication_ThModuleAuthenticationPortlet_email=" + config.TorontoHydro.Username + "&_th_module_authentication_ThModuleAuthenticationPortlet_password=" + config.TorontoHydro.Password
-	req, err = http.NewRequest("POST", loginUrl, bytes.NewBufferString(body))
+	body := url.Values{}
+	body.Set("_th_module_authentication_ThModuleAuthenticationPortlet_email", c.Username)
+	body.Set("_th_module_authentication_ThModuleAuthenticationPortlet_password", c.Password)
+	req, err = http.NewRequestWithContext(ctx, "POST", loginUrl, strings.NewReader(body.Encode()))
 	if err != nil {
-		log.Fatalf("Got error %s", err.Error())
+		c.Logger.Printf("Got error %s", err.Error())
+		return err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err = client.Do(req)
+	resp, err = c.do(req)
 	if err != nil {
-		log.Printf("Error logging into Toronto Hydro [%s]!\n", err.Error())
+		c.Logger.Printf("Error logging into Toronto Hydro [%s]!\n", err.Error())
 		return err
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("Logging into Toronto Hydro failed with status code [%d]!\n", resp.StatusCode)
-		return errors.New("Error")
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.Logger.Printf("Error processing Toronto Hydro login response [%s]!\n", err.Error())
+		return fmt.Errorf("%w: %s", ErrNetwork, err.Error())
+	}
+
+	// portal answers failed logins with the login form again
+	if isLoginPage(responseBody) {
+		c.Logger.Println("Logging into Toronto Hydro failed, check username and password!")
+		return fmt.Errorf("%w: invalid username or password", ErrAuth)
 	}
 
+	c.sessionMutex.Lock()
+	c.session++
+	c.sessionMutex.Unlock()
+
 	return nil
 }
 
-func Logout(config helpers.Config) error {
+// isLoginPage tells if the response is the login page, i.e. there is no authenticated session.
+func isLoginPage(body []byte) bool {
+	return bytes.Contains(body, []byte(loginFormID))
+}
 
-	log.Println("Logging out of Toronto Hydro... ")
+// currentSession returns the number of the current session.
+func (c *Client) currentSession() int {
+	c.sessionMutex.RLock()
+	defer c.sessionMutex.RUnlock()
+	return c.session
+}
 
-	url := "https://www.torontohydro.com/c/portal/logout"
-	if config.TorontoHydro.Mock {
-		url = "http://localhost:9999/logout"
+// relogin logs in again unless another call already did so since the given session was used.
+// A failed re-login is not repeated for the same session.
+func (c *Client) relogin(ctx context.Context, used int) error {
+	// serialize re-logins, only the first caller logs in
+	c.reloginMutex.Lock()
+	defer c.reloginMutex.Unlock()
+	if c.currentSession() != used {
+		return nil
+	}
+	if c.reloginErr != nil && c.reloginSession == used {
+		return c.reloginErr
 	}
-	req, err := http.NewRequest("GET", url, nil)
+	c.Logger.Println("Toronto Hydro session expired, logging in again")
+	err := c.Login(ctx)
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
-		return err
+		// e.g. repeated logins with a changed password might lock the account
+		c.reloginSession = used
+		c.reloginErr = err
 	}
-	resp, err := client.Do(req)
+	return err
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+
+	c.Logger.Println("Logging out of Toronto Hydro... ")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/c/portal/logout", nil)
 	if err != nil {
-		log.Printf("Error logging out [%s]!\n", err.Error())
+		c.Logger.Printf("Got error %s", err.Error())
 		return err
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("Logging out failed with status code [%d]!\n", resp.StatusCode)
-		return errors.New("Error")
+	resp, err := c.do(req)
+	if err != nil {
+		c.Logger.Printf("Error logging out [%s]!\n", err.Error())
+		return err
 	}
+	resp.Body.Close()
 
 	return nil
 }
 
-func GetMeters(config helpers.Config) ([]Meter, error) {
+func (c *Client) GetMeters(ctx context.Context) ([]Meter, error) {
+	used := c.currentSession()
+	meters, err := c.getMeters(ctx)
+	if errors.Is(err, ErrSessionExpired) {
+		err = c.relogin(ctx, used)
+		if err != nil {
+			return nil, err
+		}
+		meters, err = c.getMeters(ctx)
+	}
+	return meters, err
+}
 
-	log.Println("Getting meter list")
+func (c *Client) getMeters(ctx context.Context) ([]Meter, error) {
+
+	c.Logger.Println("Getting meter list")
 
 	// get data
-	url := "https://www.torontohydro.com/my-account/my-usage?p_p_id=thmoduletou&p_p_lifecycle=2&p_p_state=normal&p_p_mode=view&p_p_resource_id=fetchMeterList&p_p_cacheability=cacheLevelPage"
-	if config.TorontoHydro.Mock {
-		url = "http://localhost:9999/my-usage?p_p_resource_id=fetchMeterList"
-	}
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+usagePath+"fetchMeterList", nil)
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
+		c.Logger.Printf("Got error %s", err.Error())
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		log.Printf("Error getting data from Toronto Hydro [%s]!\n", err.Error())
+		c.Logger.Printf("Error getting data from Toronto Hydro [%s]!\n", err.Error())
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("Calling Toronto Hydro failed with status code [%d]!\n", resp.StatusCode)
-		return nil, errors.New("Error")
-	}
 
 	// extract body
 	defer resp.Body.Close()
+	dataBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.Logger.Printf("Error processing response from Toronto Hydro [%s]!\n", err.Error())
+		return nil, fmt.Errorf("%w: %s", ErrNetwork, err.Error())
+	}
+	if isLoginPage(dataBody) {
+		return nil, ErrSessionExpired
+	}
 	var meters []Meter
-	err = json.NewDecoder(resp.Body).Decode(&meters)
+	err = json.Unmarshal(dataBody, &meters)
 	if err != nil {
-		log.Printf("Error processing Toronto Water account details response [%s]!\n", err.Error())
-		return nil, err
+		c.Logger.Printf("Error processing Toronto Hydro meter list [%s]!\n", err.Error())
+		return nil, fmt.Errorf("%w: %s", ErrParse, err.Error())
+	}
+	for i := range meters {
+		meters[i].Account = c.Name
+		meters[i].Tags = c.Tags
 	}
 
 	return meters, nil
 }
 
-func GetData(meter Meter, date time.Time, config helpers.Config) ([]*ElectricConsumption, error) {
+// GetData returns the hourly consumptions of the meter on the calendar day of date, timestamped in Toronto time.
+func (c *Client) GetData(ctx context.Context, meter Meter, date time.Time) ([]*ElectricConsumption, error) {
+	used := c.currentSession()
+	consumptions, err := c.getData(ctx, meter, date)
+	if errors.Is(err, ErrSessionExpired) {
+		err = c.relogin(ctx, used)
+		if err != nil {
+			return nil, err
+		}
+		consumptions, err = c.getData(ctx, meter, date)
+	}
+	return consumptions, err
+}
+
+func (c *Client) getData(ctx context.Context, meter Meter, date time.Time) ([]*ElectricConsumption, error) {
 
 	dateString := date.Format("2006-01-02")
-	log.Println("Getting consumption data for meter " + meter.MeterNumber + " and date " + dateString)
+	c.Logger.Println("Getting consumption data for meter " + meter.MeterNumber + " and date " + dateString)
 
 	// get data
-	url := "https://www.torontohydro.com/my-account/my-usage?p_p_id=thmoduletou&p_p_lifecycle=2&p_p_state=normal&p_p_mode=view&p_p_resource_id=getHourlyChartData&p_p_cacheability=cacheLevelPage"
-	if config.TorontoHydro.Mock {
-		url = "http://localhost:9999/my-usage?p_p_resource_id=getHourlyChartData"
-	}
-	body := "spIDs=" + meter.Id + "&meterNum=" + meter.MeterNumber + "&date=" + dateString
-	req, err := http.NewRequest("POST", url, bytes.NewBufferString(body))
+	body := url.Values{}
+	body.Set("spIDs", meter.Id)
+	body.Set("meterNum", meter.MeterNumber)
+	body.Set("date", dateString)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+usagePath+"getHourlyChartData", strings.NewReader(body.Encode()))
 	if err != nil {
-		log.Printf("Got error %s", err.Error())
+		c.Logger.Printf("Got error %s", err.Error())
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		log.Printf("Error getting data from Toronto Hydro [%s]!\n", err.Error())
+		c.Logger.Printf("Error getting data from Toronto Hydro [%s]!\n", err.Error())
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("Calling Toronto Hydro failed with status code [%d]!\n", resp.StatusCode)
-		return nil, errors.New("Error")
-	}
 	defer resp.Body.Close()
 	dataBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("Error processing response from Toronto Hydro [%s]!\n", err.Error())
-		return nil, err
+		c.Logger.Printf("Error processing response from Toronto Hydro [%s]!\n", err.Error())
+		return nil, fmt.Errorf("%w: %s", ErrNetwork, err.Error())
+	}
+	if isLoginPage(dataBody) {
+		return nil, ErrSessionExpired
 	}
 
 	// remove comments
@@ -229,72 +442,111 @@ func GetData(meter Meter, date time.Time, config helpers.Config) ([]*ElectricCon
 	consumptions := []*ElectricConsumption{}
 	err = gocsv.UnmarshalString(filteredData, &consumptions)
 	if err != nil {
-		log.Printf("Error processing response from Toronto Hydro [%s]!\n", err.Error())
-		return nil, err
+		c.Logger.Printf("Error processing response from Toronto Hydro [%s]!\n", err.Error())
+		return nil, fmt.Errorf("%w: %s", ErrParse, err.Error())
+	}
+	if !hasData(consumptions) {
+		c.Logger.Println("No consumption data for meter " + meter.MeterNumber + " and date " + dateString + " yet")
+		return nil, ErrNotAvailable
 	}
 
 	// cleanup
+	labels := make([]string, len(consumptions))
+	for i, consumption := range consumptions {
+		labels[i] = consumption.TimeTemp
+	}
+	timestamps, err := getTimestamps(labels, date)
+	if err != nil {
+		c.Logger.Printf("Error processing response from Toronto Hydro [%s]!\n", err.Error())
+		return nil, err
+	}
+	var placed []*ElectricConsumption
+	for i, consumption := range consumptions {
+		if timestamps[i].IsZero() {
+			c.Logger.Printf("Dropping row [%s] of meter %s and date %s as the hour does not exist or is repeated\n", labels[i], meter.MeterNumber, dateString)
+			continue
+		}
+		consumption.Time = timestamps[i]
+		placed = append(placed, consumption)
+	}
+
+	return placed, nil
+}
+
+// hasData tells if any value of the consumptions is set.
+func hasData(consumptions []*ElectricConsumption) bool {
 	for _, consumption := range consumptions {
-		dateTime := getDateTime(consumption.TimeTemp, date)
-		consumption.Time = dateTime
+		if consumption.HasData() {
+			return true
+		}
 	}
+	return false
+}
+
+// hourLabel matches the labels of the hourly rows, e.g. "1 a.m." or "12 p.m.".
+var hourLabel = regexp.MustCompile(`^(\d{1,2})\s*([ap])\.?\s*m\.?$`)
 
-	return consumptions, nil
+// parseHour returns the hour of the day (0-23) of a row label.
+func parseHour(label string) (int, error) {
+	match := hourLabel.FindStringSubmatch(strings.ToLower(strings.TrimSpace(label)))
+	if match == nil {
+		return 0, fmt.Errorf("%w: unknown hour [%s]", ErrParse, label)
+	}
+	hour, _ := strconv.Atoi(match[1])
+	if hour < 1 || hour > 12 {
+		return 0, fmt.Errorf("%w: unknown hour [%s]", ErrParse, label)
+	}
+	hour = hour % 12
+	if match[2] == "p" {
+		hour += 12
+	}
+	return hour, nil
 }
 
-func getDateTime(value string, date time.Time) time.Time {
-	// could not figure out how to do this better...
-	switch {
-	case value == "12 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
-	case value == "1 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 1, 0, 0, 0, date.Location())
-	case value == "2 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 2, 0, 0, 0, date.Location())
-	case value == "3 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 3, 0, 0, 0, date.Location())
-	case value == "4 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 4, 0, 0, 0, date.Location())
-	case value == "5 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 5, 0, 0, 0, date.Location())
-	case value == "6 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 6, 0, 0, 0, date.Location())
-	case value == "7 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 7, 0, 0, 0, date.Location())
-	case value == "8 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 8, 0, 0, 0, date.Location())
-	case value == "9 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 9, 0, 0, 0, date.Location())
-	case value == "10 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 10, 0, 0, 0, date.Location())
-	case value == "11 a.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 11, 0, 0, 0, date.Location())
-	case value == "12 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, date.Location())
-	case value == "1 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 13, 0, 0, 0, date.Location())
-	case value == "2 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 14, 0, 0, 0, date.Location())
-	case value == "3 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 15, 0, 0, 0, date.Location())
-	case value == "4 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 16, 0, 0, 0, date.Location())
-	case value == "5 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 17, 0, 0, 0, date.Location())
-	case value == "6 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 18, 0, 0, 0, date.Location())
-	case value == "7 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 19, 0, 0, 0, date.Location())
-	case value == "8 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 20, 0, 0, 0, date.Location())
-	case value == "9 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 21, 0, 0, 0, date.Location())
-	case value == "10 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 22, 0, 0, 0, date.Location())
-	case value == "11 p.m.":
-		return time.Date(date.Year(), date.Month(), date.Day(), 23, 0, 0, 0, date.Location())
-	default:
-		log.Printf("Error determining date [%s]!\n", value)
-		return time.Now()
+// getTimestamps returns the start of the hour of each row of the day in Toronto time.
+// The rows are the consecutive hours since midnight, so a day with a daylight saving time change has 23 or 25 rows.
+// Rows not matching this are placed by their label, rows of hours that don't exist on the day,
+// e.g. 2 a.m. when springing forward, or that repeat an hour get a zero time and must be dropped.
+func getTimestamps(labels []string, date time.Time) ([]time.Time, error) {
+	year, month, day := date.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, Location)
+	hours := int(time.Date(year, month, day+1, 0, 0, 0, 0, Location).Sub(midnight).Hours())
+
+	parsed := make([]int, len(labels))
+	consecutive := len(labels) == hours
+	for i, label := range labels {
+		hour, err := parseHour(label)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = hour
+		if midnight.Add(time.Duration(i)*time.Hour).Hour() != hour {
+			consecutive = false
+		}
+	}
+
+	timestamps := make([]time.Time, len(labels))
+	var previous time.Time
+	for i, hour := range parsed {
+		if consecutive {
+			timestamps[i] = midnight.Add(time.Duration(i) * time.Hour)
+			continue
+		}
+
+		timestamp := time.Date(year, month, day, hour, 0, 0, 0, Location)
+		if timestamp.Hour() != hour {
+			// hour skipped when springing forward
+			continue
+		}
+		if !previous.IsZero() && !timestamp.After(previous) {
+			// hour repeated when falling back, anything else is a duplicate
+			timestamp = previous.Add(time.Hour)
+			if timestamp.Hour() != hour {
+				continue
+			}
+		}
+		timestamps[i] = timestamp
+		previous = timestamp
 	}
+	return timestamps, nil
 }
@@ -0,0 +1,272 @@
+package torontohydro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHour(t *testing.T) {
+	tests := []struct {
+		label string
+		hour  int
+		err   bool
+	}{
+		{"12 a.m.", 0, false},
+		{"1 a.m.", 1, false},
+		{"11 a.m.", 11, false},
+		{"12 p.m.", 12, false},
+		{"1 p.m.", 13, false},
+		{"11 p.m.", 23, false},
+		{" 2 A.M. ", 2, false},
+		{"3 am", 3, false},
+		{"4pm", 16, false},
+		{"", 0, true},
+		{"0 a.m.", 0, true},
+		{"13 p.m.", 0, true},
+		{"noon", 0, true},
+		{"1 x.m.", 0, true},
+	}
+	for _, test := range tests {
+		hour, err := parseHour(test.label)
+		if test.err {
+			if !errors.Is(err, ErrParse) {
+				t.Errorf("parseHour(%q) error = %v, want ErrParse", test.label, err)
+			}
+			continue
+		}
+		if err != nil || hour != test.hour {
+			t.Errorf("parseHour(%q) = %d, %v, want %d", test.label, hour, err, test.hour)
+		}
+	}
+}
+
+// hourLabels returns the labels of the given hours of the day, e.g. "12 a.m." for 0.
+func hourLabels(hours ...int) []string {
+	labels := make([]string, len(hours))
+	for i, hour := range hours {
+		suffix := "a.m."
+		if hour >= 12 {
+			suffix = "p.m."
+		}
+		if hour%12 == 0 {
+			labels[i] = "12 " + suffix
+		} else {
+			labels[i] = fmt.Sprintf("%d %s", hour%12, suffix)
+		}
+	}
+	return labels
+}
+
+// hoursExcept returns the hours of the day from 0 to 23 without the given ones.
+func hoursExcept(skip ...int) []int {
+	var hours []int
+	for hour := 0; hour < 24; hour++ {
+		skipped := false
+		for _, s := range skip {
+			skipped = skipped || s == hour
+		}
+		if !skipped {
+			hours = append(hours, hour)
+		}
+	}
+	return hours
+}
+
+func TestGetTimestamps(t *testing.T) {
+	springForward := time.Date(2023, 3, 12, 0, 0, 0, 0, Location)
+	fallBack := time.Date(2023, 11, 5, 0, 0, 0, 0, Location)
+	normal := time.Date(2023, 6, 1, 0, 0, 0, 0, Location)
+	utc := func(day int, month time.Month, hour int) string {
+		return time.Date(2023, month, day, hour, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name   string
+		date   time.Time
+		labels []string
+		// expected timestamps in UTC of some rows, empty for dropped rows
+		want map[int]string
+		rows int
+	}{
+		{
+			name:   "24 rows on normal day",
+			date:   normal,
+			labels: hourLabels(hoursExcept()...),
+			want:   map[int]string{0: utc(1, 6, 4), 23: utc(2, 6, 3)},
+			rows:   24,
+		},
+		{
+			name:   "23 rows when springing forward",
+			date:   springForward,
+			labels: hourLabels(hoursExcept(2)...),
+			want:   map[int]string{1: utc(12, 3, 6), 2: utc(12, 3, 7), 22: utc(13, 3, 3)},
+			rows:   23,
+		},
+		{
+			name:   "24 rows with non-existent hour when springing forward",
+			date:   springForward,
+			labels: hourLabels(hoursExcept()...),
+			want:   map[int]string{1: utc(12, 3, 6), 2: "", 3: utc(12, 3, 7), 23: utc(13, 3, 3)},
+			rows:   23,
+		},
+		{
+			name:   "25 rows when falling back",
+			date:   fallBack,
+			labels: hourLabels(append([]int{0, 1, 1}, hoursExcept(0, 1)...)...),
+			want:   map[int]string{1: utc(5, 11, 5), 2: utc(5, 11, 6), 3: utc(5, 11, 7), 24: utc(6, 11, 4)},
+			rows:   25,
+		},
+		{
+			name:   "24 rows without repeated hour when falling back",
+			date:   fallBack,
+			labels: hourLabels(hoursExcept()...),
+			want:   map[int]string{1: utc(5, 11, 5), 2: utc(5, 11, 7), 23: utc(6, 11, 4)},
+			rows:   24,
+		},
+		{
+			name:   "duplicate hour on normal day",
+			date:   normal,
+			labels: hourLabels(append([]int{0, 1, 1}, hoursExcept(0, 1)...)...),
+			want:   map[int]string{1: utc(1, 6, 5), 2: "", 3: utc(1, 6, 6)},
+			rows:   24,
+		},
+		{
+			name:   "missing rows",
+			date:   normal,
+			labels: hourLabels(0, 5, 23),
+			want:   map[int]string{0: utc(1, 6, 4), 1: utc(1, 6, 9), 2: utc(2, 6, 3)},
+			rows:   3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timestamps, err := getTimestamps(test.labels, test.date)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(timestamps) != len(test.labels) {
+				t.Fatalf("got %d timestamps for %d labels", len(timestamps), len(test.labels))
+			}
+
+			rows := 0
+			seen := map[int64]bool{}
+			for i, timestamp := range timestamps {
+				if timestamp.IsZero() {
+					continue
+				}
+				rows++
+				if seen[timestamp.Unix()] {
+					t.Errorf("row %d repeats %s", i, timestamp.UTC().Format(time.RFC3339))
+				}
+				seen[timestamp.Unix()] = true
+				year, month, day := timestamp.In(Location).Date()
+				if y, m, d := test.date.Date(); year != y || month != m || day != d {
+					t.Errorf("row %d placed on other day %s", i, timestamp.In(Location))
+				}
+			}
+			if rows != test.rows {
+				t.Errorf("got %d rows, want %d", rows, test.rows)
+			}
+
+			for i, want := range test.want {
+				got := ""
+				if !timestamps[i].IsZero() {
+					got = timestamps[i].UTC().Format(time.RFC3339)
+				}
+				if got != want {
+					t.Errorf("row %d [%s] = %q, want %q", i, test.labels[i], got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTimestampsBadLabel(t *testing.T) {
+	labels := hourLabels(hoursExcept()...)
+	labels[5] = "Total"
+	_, err := getTimestamps(labels, time.Date(2023, 6, 1, 0, 0, 0, 0, Location))
+	if !errors.Is(err, ErrParse) {
+		t.Errorf("error = %v, want ErrParse", err)
+	}
+}
+
+const chartHeader = "Time,Usage TOU off-peak (kWh),Usage TOU mid-peak (kWh),Usage TOU on-peak (kWh),Usage tier 1 (kWh),Usage tier 2 (kWh)," +
+	"Usage ULO overnight (kWh),Usage ULO off-peak (kWh),Usage ULO mid-peak (kWh),Usage ULO on-peak (kWh),Cost TOU off-peak ($)," +
+	"Cost TOU mid-peak ($),Cost TOU on-peak ($),Cost tier 1 ($),Cost tier 2 ($),Cost ULO overnight ($),Cost ULO off-peak ($),Cost ULO mid-peak ($),Cost ULO on-peak ($)"
+
+// chartServer wraps the mock portal, serving the given hourly data instead of the fixed one.
+func chartServer(data string) *httptest.Server {
+	mock := MockHandler()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("p_p_resource_id") == "getHourlyChartData" {
+			w.Write([]byte("2020/01/01 10:10:00 # Your hourly usage\n" + chartHeader + "\n" + data))
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+}
+
+func TestGetDataValues(t *testing.T) {
+	// tier 1 usage is empty, tier 2 usage zero and the tier 1 cost a credit
+	server := chartServer("12 a.m.,,,,,0.00,,,,,,,,-0.05,0.00,,,,\n1 a.m.,,,,0.21,0.00,,,,,,,,0.02,0.00,,,,")
+	defer server.Close()
+	client := newTestClient(server, "secret")
+	if err := client.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2022, 1, 1, 0, 0, 0, 0, Location)
+	consumptions, err := client.GetData(context.Background(), Meter{MeterNumber: "1234"}, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consumptions) != 2 {
+		t.Fatalf("%d hours, want 2", len(consumptions))
+	}
+	first := consumptions[0]
+	if !first.Time.Equal(date) {
+		t.Errorf("time = %s, want %s", first.Time, date)
+	}
+	if first.UsageLowTier != nil {
+		t.Errorf("empty cell = %v, want nil", *first.UsageLowTier)
+	}
+	if first.UsageHighTier == nil || *first.UsageHighTier != 0 {
+		t.Errorf("zero cell = %v, want pointer to 0", first.UsageHighTier)
+	}
+	if first.CostLowTier == nil || *first.CostLowTier != -0.05 {
+		t.Errorf("negative cell = %v, want pointer to -0.05", first.CostLowTier)
+	}
+	if first.UsageTOUOffPeak != nil || first.CostULOOnPeak != nil {
+		t.Error("empty cells of other plans are set")
+	}
+	if second := consumptions[1]; second.UsageLowTier == nil || *second.UsageLowTier != 0.21 {
+		t.Errorf("usage of second hour = %v, want 0.21", second.UsageLowTier)
+	}
+}
+
+func TestGetDataNotAvailable(t *testing.T) {
+	var rows []string
+	for _, label := range hourLabels(hoursExcept()...) {
+		rows = append(rows, label+strings.Repeat(",", 18))
+	}
+	server := chartServer(strings.Join(rows, "\n"))
+	defer server.Close()
+	client := newTestClient(server, "secret")
+	if err := client.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	consumptions, err := client.GetData(context.Background(), Meter{MeterNumber: "1234"}, time.Date(2022, 1, 1, 0, 0, 0, 0, Location))
+	if !errors.Is(err, ErrNotAvailable) {
+		t.Errorf("err = %v, want ErrNotAvailable", err)
+	}
+	if consumptions != nil {
+		t.Errorf("%d hours returned for a day without data", len(consumptions))
+	}
+}
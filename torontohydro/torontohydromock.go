@@ -3,34 +3,49 @@ package torontohydro
 import (
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"time"
 )
 
-func Mock() {
+// Mock starts a server imitating the Toronto Hydro portal and returns its base url.
+func Mock() string {
 	log.Println("Mocking Toronto Hydro!")
 
-	http.HandleFunc("/log-in", login)
-	http.HandleFunc("/logout", logout)
-	http.HandleFunc("/my-usage", myusage)
-
-	go func() {
-		log.Fatal(http.ListenAndServe(":9999", nil))
-	}()
+	server := httptest.NewServer(MockHandler())
+	return server.URL
 }
 
+// MockHandler imitates the Toronto Hydro portal, e.g. to be used with httptest.
+func MockHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/log-in", login)
+	mux.HandleFunc("/c/portal/logout", logout)
+	mux.HandleFunc("/my-account/my-usage", myusage)
+	return mux
+}
 func login(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("<form action=\"https://www.torontohydro.com/log-in?p_p_id=th_module_authentication_ThModuleAuthenticationPortlet&p_p_lifecycle=1&p_p_state=normal&p_p_mode=view&_th_module_authentication_ThModuleAuthenticationPortlet_javax.portlet.action=%2Flogin&p_auth=PlXHUFya\" id=\"_th_module_authentication_ThModuleAuthenticationPortlet_authentication\" method=\"post\"></form>"))
+		loginPage(w, r)
 	case "POST":
+		// any password but "invalid" is accepted
+		if r.FormValue("_th_module_authentication_ThModuleAuthenticationPortlet_password") == "invalid" {
+			loginPage(w, r)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "mock", Path: "/"})
 		w.Header().Set("Content-Type", "application/text")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Logged in!"))
 	}
 }
 
+func loginPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("<form action=\"http://" + r.Host + "/log-in?p_p_id=th_module_authentication_ThModuleAuthenticationPortlet&p_p_lifecycle=1&p_p_state=normal&p_p_mode=view&_th_module_authentication_ThModuleAuthenticationPortlet_javax.portlet.action=%2Flogin&p_auth=PlXHUFya\" id=\"_th_module_authentication_ThModuleAuthenticationPortlet_authentication\" method=\"post\"></form>"))
+}
+
 func logout(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/text")
 	w.WriteHeader(http.StatusOK)
@@ -38,6 +53,12 @@ func logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func myusage(w http.ResponseWriter, r *http.Request) {
+	// without session the portal bounces to the login page
+	if _, err := r.Cookie("JSESSIONID"); err != nil {
+		loginPage(w, r)
+		return
+	}
+
 	resource := r.URL.Query().Get("p_p_resource_id")
 	if resource == "fetchMeterList" {
 		data := `[